@@ -4,40 +4,96 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"rinha/internal/api"
+	"rinha/internal/config"
 	db "rinha/internal/database"
 	listener "rinha/internal/listener"
+	"rinha/internal/logging"
+	"rinha/internal/metrics"
+	"rinha/internal/tracing"
 )
 
 var gendoc = flag.Bool("routes", false, "Generate router documentation")
 
 func main() {
 
-	flag.Parse()
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if flag.Arg(0) == "reconcile" {
+		os.Exit(reconcileCmd(cfg, flag.Args()[1:]))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logger, err := logging.New(os.Stdout, cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter: cfg.TraceExporter,
+		File:     cfg.TraceFile,
+		Endpoint: cfg.TraceEndpoint,
+		Sample:   cfg.TraceSample,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	pool, err := db.Connect(context.Background(), cfg.DatabaseUrl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	store := db.NewPgxStore(pool)
+	metrics.Registry.MustRegister(metrics.NewPoolCollector(pool), metrics.NewQueueCollector(store.QueueDepth))
+
+	l := listener.Listen(store, cfg)
+	server := api.CreateRoutes(store, l, cfg, *gendoc)
 
-	db.Connect()
-	listener.Listen()
-	server := api.CreateRoutes(*gendoc)
+	reconcileCtx, stopReconcile := context.WithCancel(context.Background())
+	startReconciler(reconcileCtx, cfg)
 
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM)
 	<-sc
-	fmt.Println("shutdown amigo...")
+	slog.Info("shutdown amigo...")
 
-	listener.Stop()
+	stopReconcile()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond) // Set a timeout for shutdown
+	// no new payments first, then let the listener finish the ones it holds
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		fmt.Println(err.Error())
-		fmt.Println("failed to stop api http server")
+		slog.Error("failed to stop api http server", "err", err)
+	}
+	slog.Info("api stopped")
+
+	if err := l.Stop(cfg.DrainTimeout); err != nil {
+		slog.Error("failed to stop listener", "err", err)
+	}
+	store.Close()
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancelFlush()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("failed to flush traces", "err", err)
 	}
-	fmt.Println("api stopped")
-	db.Disconnect()
 }
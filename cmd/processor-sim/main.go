@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"rinha/internal/processorsim"
+)
+
+// local payment processor, run one per processor:
+// go run ./cmd/processor-sim -addr :8001 -fee 0.05
+// go run ./cmd/processor-sim -addr :8002 -fee 0.15
+
+func main() {
+	cfg := processorsim.DefaultConfig()
+
+	addr := flag.String("addr", ":8001", "listen address")
+	flag.Float64Var(&cfg.Fee, "fee", cfg.Fee, "fee per transaction")
+	flag.StringVar(&cfg.Token, "token", cfg.Token, "X-Rinha-Token for /admin routes")
+	flag.DurationVar(&cfg.Delay, "delay", cfg.Delay, "delay added to every payment")
+	flag.BoolVar(&cfg.Failure, "failure", cfg.Failure, "fail every payment with 500")
+	flag.Float64Var(&cfg.FailureRate, "failure-rate", cfg.FailureRate, "fraction of payments failing with 500")
+	flag.DurationVar(&cfg.HealthInterval, "health-interval", cfg.HealthInterval, "service-health rate limit")
+	flag.Parse()
+
+	sim := processorsim.New(cfg)
+
+	fmt.Printf("payment processor simulator started %v fee: %v\n", *addr, cfg.Fee)
+	if err := http.ListenAndServe(*addr, sim.Handler()); err != nil {
+		log.Fatalf("HTTP server ListenAndServe: %v", err)
+	}
+}
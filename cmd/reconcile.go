@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"rinha/internal/config"
+	"rinha/internal/reconcile"
+	p "rinha/pkg/protocol"
+)
+
+// our api as seen from this host
+func localUrl(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+func processors(defaultUrl, fallbackUrl string) []reconcile.Processor {
+	return []reconcile.Processor{
+		{Service: p.DefaultProcessor, Url: defaultUrl},
+		{Service: p.FallbackProcessor, Url: fallbackUrl},
+	}
+}
+
+// rinha reconcile [-api url] [-from t] [-to t] [-json]
+// exits 1 when the totals differ, 2 when the check itself fails
+func reconcileCmd(cfg *config.Config, args []string) int {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	apiUrl := fs.String("api", localUrl(cfg.Addr), "our api base url")
+	defaultUrl := fs.String("default", cfg.DefaultProcessorUrl, "default processor base url")
+	fallbackUrl := fs.String("fallback", cfg.FallbackProcessorUrl, "fallback processor base url")
+	token := fs.String("token", cfg.ProcessorToken, "processors X-Rinha-Token")
+	fromArg := fs.String("from", "", "window start, RFC3339")
+	toArg := fs.String("to", "", "window end, RFC3339")
+	asJson := fs.Bool("json", false, "print the report as json")
+	fs.Parse(args)
+
+	var from, to time.Time
+	var err error
+	if *fromArg != "" {
+		if from, err = time.Parse(time.RFC3339Nano, *fromArg); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to parse -from:", err)
+			return 2
+		}
+	}
+	if *toArg != "" {
+		if to, err = time.Parse(time.RFC3339Nano, *toArg); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to parse -to:", err)
+			return 2
+		}
+	}
+
+	rc := &reconcile.Reconciler{
+		ApiUrl:     *apiUrl,
+		Processors: processors(*defaultUrl, *fallbackUrl),
+		Token:      *token,
+		Client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	report, err := rc.Run(context.Background(), from, to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "reconcile failed:", err)
+		return 2
+	}
+
+	if *asJson {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		report.Print(os.Stdout)
+	}
+	if !report.Match() {
+		return 1
+	}
+	return 0
+}
+
+// periodic reconciliation inside the api, enabled by RECONCILE_INTERVAL
+// (e.g. 1m). Payments from the last RECONCILE_SETTLE are left out, they may
+// still be in flight.
+func startReconciler(ctx context.Context, cfg *config.Config) {
+	if cfg.ReconcileInterval <= 0 {
+		return
+	}
+
+	rc := &reconcile.Reconciler{
+		ApiUrl:     localUrl(cfg.Addr),
+		Processors: processors(cfg.DefaultProcessorUrl, cfg.FallbackProcessorUrl),
+		Token:      cfg.ProcessorToken,
+		Client:     &http.Client{Timeout: 30 * time.Second},
+	}
+	go rc.Watch(ctx, cfg.ReconcileInterval, cfg.ReconcileSettle, func(report *reconcile.Report) {
+		var details strings.Builder
+		report.Print(&details)
+		slog.Warn("summary differs from the processors", "report", details.String())
+	})
+}
@@ -4,10 +4,18 @@ CREATE UNLOGGED TABLE payments (
     requested_at TIMESTAMPTZ NOT NULL,
     status TEXT NOT NULL DEFAULT 'pending',
     service TEXT, 
-    processed_at TIMESTAMPTZ
+    processed_at TIMESTAMPTZ,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    last_attempt_at TIMESTAMPTZ,
+    claimed_at TIMESTAMPTZ,
+    lease_until TIMESTAMPTZ,
+    -- W3C traceparent of the request that created it, the worker continues the trace
+    trace_parent TEXT
 );
 
-CREATE INDEX payments_requested_at ON payments (requested_at);
+-- keyset pagination of GET /payments
+CREATE INDEX payments_requested_at ON payments (requested_at, correlation_id);
 CREATE INDEX idx_payments_pending_jobs ON payments (requested_at)
 WHERE status = 'pending';
 
@@ -16,16 +24,38 @@ WHERE status = 'completed';
 
 CREATE INDEX idx_payments_status_service_requested_at ON payments (status, service, requested_at);
 
--- one row table to store median value
-CREATE UNLOGGED TABLE processing_metrics (
-    metric_name TEXT PRIMARY KEY,
-    metric_value BIGINT NOT NULL,
-    updated_at TIMESTAMPTZ NOT NULL
+-- claimed payments whose worker may be gone, see lease reaper
+CREATE INDEX idx_payments_leases ON payments (lease_until)
+WHERE status = 'processing';
+
+-- dead-lettered payments, out of attempts or rejected by the processors
+CREATE INDEX idx_payments_failed ON payments (last_attempt_at DESC)
+WHERE status = 'failed';
+
+-- append only history of every payment state change and processor call
+CREATE UNLOGGED TABLE payment_events (
+    id BIGSERIAL PRIMARY KEY,
+    correlation_id UUID NOT NULL,
+    event TEXT NOT NULL,
+    service TEXT,
+    status_code INTEGER,
+    latency_ms DOUBLE PRECISION,
+    detail TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_payment_events_correlation_id ON payment_events (correlation_id, id);
+
+-- latest service-health answer of each payment processor, checked_at also
+-- works as a lock so only one worker polls a processor every 5 seconds
+CREATE UNLOGGED TABLE processor_health (
+    service TEXT PRIMARY KEY,
+    failing BOOLEAN NOT NULL DEFAULT FALSE,
+    min_response_time INTEGER NOT NULL DEFAULT 0,
+    checked_at TIMESTAMPTZ NOT NULL DEFAULT '-infinity'
 );
 
--- Pre-populate it with a starting value
-INSERT INTO processing_metrics (metric_name, metric_value, updated_at) 
-VALUES ('rolling_average', 0, NOW());
+INSERT INTO processor_health (service) VALUES ('default'), ('fallback');
 
 CREATE OR REPLACE FUNCTION fn_notify_new_payment()
 RETURNS TRIGGER AS $$
@@ -39,31 +69,3 @@ CREATE TRIGGER trg_after_insert_on_payments
 AFTER INSERT ON payments
 FOR EACH ROW
 EXECUTE FUNCTION fn_notify_new_payment();
-
--- procedure to update one row table and return it
-CREATE OR REPLACE FUNCTION update_rolling_payment_average()
-RETURNS BIGINT AS $$
-DECLARE
-    new_metric_value BIGINT;
-BEGIN
-    INSERT INTO processing_metrics (metric_name, metric_value, updated_at)
-    SELECT
-        'rolling_average',
-        ROUND(COALESCE(percentile_cont(0.5) WITHIN GROUP (ORDER BY amount), 0))::BIGINT,
-        NOW()
-    FROM (
-        SELECT amount
-        FROM payments
-        WHERE status = 'completed'
-        ORDER BY processed_at DESC
-        LIMIT 10
-    ) AS latest_payments
-    ON CONFLICT (metric_name) DO UPDATE
-    SET
-        metric_value = EXCLUDED.metric_value,
-        updated_at = EXCLUDED.updated_at
-    RETURNING metric_value INTO new_metric_value;
-    
-    RETURN new_metric_value;
-END;
-$$ LANGUAGE plpgsql;
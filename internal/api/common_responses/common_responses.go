@@ -3,6 +3,8 @@ package api
 import (
 	"net/http"
 
+	p "rinha/pkg/protocol"
+
 	"github.com/go-chi/render"
 )
 
@@ -37,6 +39,30 @@ func ErrRender(err error) render.Renderer {
 	}
 }
 
+type ValidationResponse struct {
+	Response
+	Errors p.ValidationErrors `json:"errors"`
+}
+
+// field level errors, 400 when a required field is missing and 422 when
+// fields are present but invalid
+func ErrValidation(errs p.ValidationErrors) render.Renderer {
+	status := http.StatusUnprocessableEntity
+	for _, fe := range errs {
+		if fe.Code == p.Required {
+			status = http.StatusBadRequest
+			break
+		}
+	}
+	return &ValidationResponse{
+		Response: Response{
+			HTTPStatusCode: status,
+			StatusText:     "invalid payment.",
+		},
+		Errors: errs,
+	}
+}
+
 func ErrNotFound() render.Renderer {
 	return &Response{
 		HTTPStatusCode: http.StatusNotFound,
@@ -51,9 +77,30 @@ func ErrInvalidRequest(message string) render.Renderer {
 	}
 }
 
+func ErrConflict(message string) render.Renderer {
+	return &Response{
+		HTTPStatusCode: http.StatusConflict,
+		StatusText:     message,
+	}
+}
+
 func ErrServerInternal() render.Renderer {
 	return &Response{
 		HTTPStatusCode: http.StatusInternalServerError,
 		StatusText:     "unknown",
 	}
 }
+
+func ErrTimeout() render.Renderer {
+	return &Response{
+		HTTPStatusCode: http.StatusGatewayTimeout,
+		StatusText:     "request timed out.",
+	}
+}
+
+func ErrUnavailable() render.Renderer {
+	return &Response{
+		HTTPStatusCode: http.StatusServiceUnavailable,
+		StatusText:     "unavailable.",
+	}
+}
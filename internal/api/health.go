@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	cr "rinha/internal/api/common_responses"
+	db "rinha/internal/database"
+	"rinha/internal/listener"
+	p "rinha/pkg/protocol"
+
+	"github.com/go-chi/render"
+)
+
+// how long readiness waits postgres
+const readyPingTimeout = time.Second
+
+type Check struct {
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type ReadyResponse struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks"`
+	code   int
+}
+
+func (rr *ReadyResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	render.Status(r, rr.code)
+	return nil
+}
+
+type HealthHandler struct {
+	store    db.Store
+	listener *listener.Listener
+	draining atomic.Bool // server shutting down, traffic should go elsewhere
+}
+
+// GET /healthz
+
+// HTTP 200 - Ok
+// {
+//     "status": "ok"
+// }
+
+func (hh *HealthHandler) healthz(r *http.Request, w http.ResponseWriter) {
+	render.Render(w, r, &cr.Response{HTTPStatusCode: http.StatusOK, StatusText: "ok"})
+}
+
+// GET /readyz
+
+// HTTP 200 - Ok | HTTP 503 - Service Unavailable
+// {
+//     "status": "ready",
+//     "checks": {
+//         "database": { "ok": true },
+//         "listener": { "ok": true, "detail": "21/21 workers running" },
+//         "processors": { "ok": true, "detail": "default up, fallback failing" }
+//     }
+// }
+
+func (hh *HealthHandler) readyz(r *http.Request, w http.ResponseWriter) {
+	checks := map[string]Check{}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyPingTimeout)
+	defer cancel()
+	if err := hh.store.Ping(ctx); err != nil {
+		checks["database"] = Check{Detail: err.Error()}
+	} else {
+		checks["database"] = Check{Ok: true}
+	}
+
+	status := hh.listener.Status()
+	listenerCheck := Check{
+		Ok:     status.Running == status.Expected && !status.Stopping,
+		Detail: fmt.Sprintf("%v/%v workers running", status.Running, status.Expected),
+	}
+	if status.Stopping {
+		listenerCheck.Detail += ", stopping"
+	}
+	checks["listener"] = listenerCheck
+
+	// at least one processor to route payments to
+	processors := Check{}
+	for _, service := range []string{p.DefaultProcessor, p.FallbackProcessor} {
+		state := "up"
+		if status.Processors[service].Failing {
+			state = "failing"
+		} else {
+			processors.Ok = true
+		}
+		if processors.Detail != "" {
+			processors.Detail += ", "
+		}
+		processors.Detail += service + " " + state
+	}
+	checks["processors"] = processors
+
+	if hh.draining.Load() {
+		checks["server"] = Check{Detail: "shutting down"}
+	}
+
+	resp := &ReadyResponse{Status: "ready", Checks: checks, code: http.StatusOK}
+	for _, check := range checks {
+		if !check.Ok {
+			resp.Status = "not ready"
+			resp.code = http.StatusServiceUnavailable
+		}
+	}
+	render.Render(w, r, resp)
+}
+
+// GET /
+
+// HTTP 200 - Ok | HTTP 503 - Service Unavailable
+// Hello, world!
+
+func (hh *HealthHandler) hello(r *http.Request, w http.ResponseWriter) {
+	if err := hh.store.Ping(r.Context()); err != nil {
+		slog.ErrorContext(r.Context(), "database ping failed", "err", err)
+		render.Render(w, r, cr.ErrUnavailable())
+		return
+	}
+	w.Write([]byte("Hello, world!"))
+}
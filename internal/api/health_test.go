@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"rinha/internal/listener/listenertest"
+	"rinha/internal/processorsim"
+)
+
+func readyz(t *testing.T, hh *HealthHandler) (int, ReadyResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	hh.readyz(httptest.NewRequest(http.MethodGet, "/readyz", nil), rec)
+
+	resp := ReadyResponse{}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, resp
+}
+
+func TestReadyzFollowsTheListener(t *testing.T) {
+	env := listenertest.Start(t, processorsim.New(processorsim.DefaultConfig()).Handler(), nil)
+	l := env.Listener
+	hh := &HealthHandler{store: env.Store, listener: l}
+
+	if code, resp := readyz(t, hh); code != http.StatusOK {
+		t.Fatalf("readyz %v: %+v", code, resp)
+	}
+
+	l.Stop(time.Second)
+	code, resp := readyz(t, hh)
+	if code != http.StatusServiceUnavailable || resp.Status != "not ready" {
+		t.Fatalf("readyz after stop %v: %+v", code, resp)
+	}
+	if resp.Checks["listener"].Ok || !resp.Checks["database"].Ok {
+		t.Errorf("unexpected checks %+v", resp.Checks)
+	}
+
+	rec := httptest.NewRecorder()
+	hh.healthz(httptest.NewRequest(http.MethodGet, "/healthz", nil), rec)
+	if rec.Code != http.StatusOK {
+		t.Errorf("healthz %v", rec.Code)
+	}
+}
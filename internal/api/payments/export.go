@@ -0,0 +1,173 @@
+package payments
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	cr "rinha/internal/api/common_responses"
+	db "rinha/internal/database"
+
+	"github.com/go-chi/render"
+)
+
+const (
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeCSV    = "text/csv"
+)
+
+// rows written between flushes
+const exportFlushEvery = 1000
+
+var exportHeader = []string{"correlationId", "amount", "requestedAt", "status", "service", "processedAt"}
+
+// export format from ?format=ndjson|csv, falling back to the Accept header
+func exportFormat(r *http.Request) (string, bool) {
+	switch r.URL.Query().Get("format") {
+	case "ndjson":
+		return contentTypeNDJSON, true
+	case "csv":
+		return contentTypeCSV, true
+	case "":
+	default:
+		return "", false
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), contentTypeCSV) {
+		return contentTypeCSV, true
+	}
+	return contentTypeNDJSON, true
+}
+
+type rowWriter interface {
+	write(rec *ExportRecord) error
+	flush() error
+}
+
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (nw *ndjsonWriter) write(rec *ExportRecord) error {
+	return nw.enc.Encode(rec) // Encode already ends every record with \n
+}
+
+func (nw *ndjsonWriter) flush() error {
+	return nil
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvWriter) write(rec *ExportRecord) error {
+	service, processedAt := "", ""
+	if rec.Service != nil {
+		service = *rec.Service
+	}
+	if rec.ProcessedAt != nil {
+		processedAt = rec.ProcessedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return cw.w.Write([]string{
+		rec.CorrelationId,
+		rec.Amount.String(),
+		rec.RequestedAt.UTC().Format(time.RFC3339Nano),
+		rec.Status,
+		service,
+		processedAt,
+	})
+}
+
+func (cw *csvWriter) flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+func newRowWriter(contentType string, w io.Writer) (rowWriter, error) {
+	if contentType == contentTypeCSV {
+		cw := &csvWriter{w: csv.NewWriter(w)}
+		return cw, cw.w.Write(exportHeader)
+	}
+	return &ndjsonWriter{enc: json.NewEncoder(w)}, nil
+}
+
+// GET /payments/export?format=ndjson|csv
+// same filters as GET /payments, every matching row unless limit is given
+
+// HTTP 200 - Ok
+// {"correlationId":"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3","amount":19.90,"requestedAt":"2025-07-15T12:34:56Z","status":"completed","service":"default","processedAt":"2025-07-15T12:34:56.1Z"}
+// ...
+
+func (ph *PaymentHandler) exportPayments(r *http.Request, w http.ResponseWriter) {
+	contentType, ok := exportFormat(r)
+	if !ok {
+		render.Render(w, r, cr.ErrInvalidRequest("'format' must be ndjson or csv"))
+		return
+	}
+
+	filter, err := parsePaymentFilter(r)
+	if err != nil {
+		render.Render(w, r, cr.ErrInvalidRequest(err.Error()))
+		return
+	}
+	if r.URL.Query().Get("limit") == "" {
+		filter.Limit = 0
+	}
+
+	var out rowWriter
+	flusher, _ := w.(http.Flusher)
+
+	// status line goes out with the first row, so a failing query still gets a 500
+	start := func() (err error) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		out, err = newRowWriter(contentType, w)
+		return err
+	}
+
+	// once started, errors can only end the stream early. Rows only count
+	// as written once flushed out of the row writer buffer.
+	written, buffered := 0, 0
+	err = ph.store.ListPayments(r.Context(), *filter, func(rec *db.PaymentRecord) error {
+		if out == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := out.write(newExportRecord(rec)); err != nil {
+			return err
+		}
+
+		buffered++
+		if buffered == exportFlushEvery {
+			if err := out.flush(); err != nil {
+				return err
+			}
+			written, buffered = written+buffered, 0
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+
+	if err != nil && out == nil {
+		storeError(w, r, err)
+		return
+	}
+	if err == nil && out == nil {
+		err = start() // no rows, still a valid (csv header only) export
+	}
+	if err == nil {
+		if err = out.flush(); err == nil {
+			written += buffered
+		}
+	}
+	if err != nil {
+		slog.WarnContext(r.Context(), "export stopped", "rows", written, "err", err)
+	}
+}
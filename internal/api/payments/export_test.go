@@ -0,0 +1,89 @@
+package payments
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	p "rinha/pkg/protocol"
+)
+
+func export(t *testing.T, url string, accept string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// one more row than a flush holds, so the stream spans a flush
+func TestExportFormatByAcceptHeader(t *testing.T) {
+	srv, store := newTestServer(t)
+
+	const rows = exportFlushEvery + 1
+	for i := range rows {
+		id := fmt.Sprintf("%08x-7d26-4d9d-aa19-4dc1c7cf60b3", i)
+		if err := store.InsertPayment(t.Context(), &p.Payment{CorrelationId: id, Amount: 19_90}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query, accept string
+		contentType   string
+	}{
+		{"", "", contentTypeNDJSON},
+		{"", "application/json", contentTypeNDJSON},
+		{"", contentTypeCSV, contentTypeCSV},
+		{"", "text/csv;q=0.9, */*;q=0.1", contentTypeCSV},
+		{"?format=ndjson", contentTypeCSV, contentTypeNDJSON},
+		{"?format=csv", "", contentTypeCSV},
+	} {
+		resp := export(t, srv.URL+"/payments/export"+tc.query, tc.accept)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != tc.contentType {
+			t.Errorf("%q Accept %q: status %v, %v, want %v", tc.query, tc.accept, resp.StatusCode, resp.Header.Get("Content-Type"), tc.contentType)
+			continue
+		}
+
+		got := 0
+		if tc.contentType == contentTypeCSV {
+			records, err := csv.NewReader(resp.Body).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) == 0 || fmt.Sprint(records[0]) != fmt.Sprint(exportHeader) {
+				t.Fatalf("%q Accept %q: missing csv header", tc.query, tc.accept)
+			}
+			got = len(records) - 1
+		} else {
+			lines := bufio.NewScanner(resp.Body)
+			for lines.Scan() {
+				rec := ExportRecord{}
+				if err := json.Unmarshal(lines.Bytes(), &rec); err != nil {
+					t.Fatalf("%q Accept %q: line %v: %v", tc.query, tc.accept, got+1, err)
+				}
+				got++
+			}
+		}
+		if got != rows {
+			t.Errorf("%q Accept %q: streamed %v rows, want %v", tc.query, tc.accept, got, rows)
+		}
+	}
+
+	if resp := export(t, srv.URL+"/payments/export?format=xml", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("format=xml: status %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,146 @@
+package payments
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	db "rinha/internal/database"
+	p "rinha/pkg/protocol"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// opaque GET /payments cursor
+func encodeCursor(c db.Cursor) string {
+	raw := c.RequestedAt.UTC().Format(time.RFC3339Nano) + "," + c.CorrelationId
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(value string) (*db.Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	at, id, ok := strings.Cut(string(raw), ",")
+	if !ok || !p.IsUUID(id) {
+		return nil, errors.New("malformed cursor")
+	}
+	requestedAt, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return nil, err
+	}
+	return &db.Cursor{RequestedAt: requestedAt, CorrelationId: id}, nil
+}
+
+// GET /payments query parameters
+// ?status=completed&service=default&minAmount=10&maxAmount=20.50
+// &from=2020-07-10T12:34:56.000Z&to=2020-07-10T12:35:56.000Z
+// &sort=asc|desc&limit=100&cursor=...
+// errors are meant to be sent back to the client
+func parsePaymentFilter(r *http.Request) (*db.PaymentQuery, error) {
+	query := r.URL.Query()
+	f := &db.PaymentQuery{Limit: defaultPageSize}
+
+	if f.Status = query.Get("status"); f.Status != "" && !slices.Contains(db.PaymentStatuses, f.Status) {
+		return nil, fmt.Errorf("'status' must be one of %s", strings.Join(db.PaymentStatuses, ", "))
+	}
+
+	if f.Service = query.Get("service"); f.Service != "" && f.Service != p.DefaultProcessor && f.Service != p.FallbackProcessor {
+		return nil, errors.New("'service' must be default or fallback")
+	}
+
+	for _, param := range []struct {
+		name   string
+		amount **p.Money
+	}{{"minAmount", &f.MinAmount}, {"maxAmount", &f.MaxAmount}} {
+		if value := query.Get(param.name); value != "" {
+			amount, err := p.ParseMoney(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse '%s'", param.name)
+			}
+			*param.amount = &amount
+		}
+	}
+
+	var err error
+	if f.From, err = parseTimeParam(r, "from"); err != nil {
+		return nil, errors.New("failed to parse 'from' date")
+	}
+	if f.To, err = parseTimeParam(r, "to"); err != nil {
+		return nil, errors.New("failed to parse 'to' date")
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && f.From.After(f.To) {
+		return nil, errors.New("'from' must not be after 'to'")
+	}
+
+	switch query.Get("sort") {
+	case "", "asc":
+	case "desc":
+		f.Descending = true
+	default:
+		return nil, errors.New("'sort' must be asc or desc")
+	}
+
+	if value := query.Get("limit"); value != "" {
+		f.Limit, err = strconv.Atoi(value)
+		if err != nil || f.Limit < 1 || f.Limit > maxPageSize {
+			return nil, fmt.Errorf("'limit' must be between 1 and %d", maxPageSize)
+		}
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		if f.After, err = decodeCursor(value); err != nil {
+			return nil, errors.New("invalid 'cursor'")
+		}
+	}
+
+	return f, nil
+}
+
+// summary window basis parameter
+var summaryBasis = map[string]string{
+	"":          db.BasisRequested,
+	"requested": db.BasisRequested,
+	"processed": db.BasisProcessed,
+}
+
+// GET /payments-summary query parameters
+// ?from=2020-07-10T12:34:56.000Z&to=2020-07-10T12:35:56.000Z
+// &basis=requested|processed&breakdown=status
+// the window and whether totals per status were asked for, errors are meant
+// to be sent back to the client
+func parseSummaryQuery(r *http.Request) (*db.SummaryWindow, bool, error) {
+	query := r.URL.Query()
+	w := &db.SummaryWindow{}
+
+	var err error
+	if w.From, err = parseTimeParam(r, "from"); err != nil {
+		return nil, false, errors.New("failed to parse 'from' date")
+	}
+	if w.To, err = parseTimeParam(r, "to"); err != nil {
+		return nil, false, errors.New("failed to parse 'to' date")
+	}
+	if !w.From.IsZero() && !w.To.IsZero() && w.From.After(w.To) {
+		return nil, false, errors.New("'from' must not be after 'to'")
+	}
+
+	var ok bool
+	if w.Basis, ok = summaryBasis[query.Get("basis")]; !ok {
+		return nil, false, errors.New("'basis' must be requested or processed")
+	}
+
+	breakdown := query.Get("breakdown")
+	if breakdown != "" && breakdown != "status" {
+		return nil, false, errors.New("'breakdown' must be status")
+	}
+	return w, breakdown == "status", nil
+}
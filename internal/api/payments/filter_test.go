@@ -0,0 +1,124 @@
+package payments
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	db "rinha/internal/database"
+	p "rinha/pkg/protocol"
+)
+
+func TestSummaryQueryValidation(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"from=2020-07-10T12:34:56Z&to=2020-07-10T12:35:56Z", http.StatusOK},
+		{"from=2020-07-10T12:34:56.123Z&to=2020-07-10T12:34:56.123Z", http.StatusOK},
+		{"from=2020-07-10T12:34:56-03:00", http.StatusOK},
+		{"from=2020-07-10", http.StatusBadRequest},
+		{"from=yesterday", http.StatusBadRequest},
+		{"to=2020-13-10T12:34:56Z", http.StatusBadRequest},
+		{"from=2020-07-10T12:35:56Z&to=2020-07-10T12:34:56Z", http.StatusBadRequest},
+		{"basis=processed&breakdown=status", http.StatusOK},
+		{"basis=settled", http.StatusBadRequest},
+		{"breakdown=service", http.StatusBadRequest},
+	} {
+		if code := getJSON(t, srv.URL+"/payments-summary?"+tc.query, nil); code != tc.status {
+			t.Errorf("GET /payments-summary?%v: status %v, want %v", tc.query, code, tc.status)
+		}
+	}
+}
+
+func TestListQueryValidation(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"from=2020-07-10T12:34:56Z&to=2020-07-10T12:35:56Z", http.StatusOK},
+		{"from=2020-07-10T12:35:56Z&to=2020-07-10T12:34:56Z", http.StatusBadRequest},
+		{"from=2020-07-10", http.StatusBadRequest},
+		{"to=not-a-date", http.StatusBadRequest},
+		{"status=lost", http.StatusBadRequest},
+		{"service=backup", http.StatusBadRequest},
+		{"minAmount=10&maxAmount=20.50", http.StatusOK},
+		{"minAmount=1e1", http.StatusOK},
+		{"minAmount=1/2", http.StatusBadRequest},
+		{"maxAmount=0x10", http.StatusBadRequest},
+		{"maxAmount=abc", http.StatusBadRequest},
+		{"minAmount=0.001", http.StatusBadRequest},
+	} {
+		if code := getJSON(t, srv.URL+"/payments?"+tc.query, nil); code != tc.status {
+			t.Errorf("GET /payments?%v: status %v, want %v", tc.query, code, tc.status)
+		}
+	}
+}
+
+// totals keyed by the service that processed them, not by row order
+func TestSummaryKeyedByService(t *testing.T) {
+	srv, store := newTestServer(t)
+
+	post(t, srv.URL+"/payments", `{"correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", "amount": 1.00}`)
+	post(t, srv.URL+"/payments", `{"correlationId": "5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4", "amount": 2.00}`)
+	post(t, srv.URL+"/payments", `{"correlationId": "6c9b13da-9f48-4f1f-8c3b-6fe3e9e182d5", "amount": 4.00}`)
+	complete(t, store, "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", p.FallbackProcessor)
+	complete(t, store, "5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4", p.DefaultProcessor)
+	complete(t, store, "6c9b13da-9f48-4f1f-8c3b-6fe3e9e182d5", p.DefaultProcessor)
+
+	summary := SummaryResponse{}
+	getJSON(t, srv.URL+"/payments-summary", &summary)
+	if want := (Service{TotalRequests: 2, TotalAmount: 6_00}); summary.Default != want {
+		t.Errorf("default %+v, want %+v", summary.Default, want)
+	}
+	if want := (Service{TotalRequests: 1, TotalAmount: 1_00}); summary.Fallback != want {
+		t.Errorf("fallback %+v, want %+v", summary.Fallback, want)
+	}
+}
+
+// processed basis only counts settled payments, with or without a window
+func TestSummaryProcessedBasis(t *testing.T) {
+	srv, store := newTestServer(t)
+
+	const completed, failed, pending = "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", "5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4", "6c9b13da-9f48-4f1f-8c3b-6fe3e9e182d5"
+	for _, id := range []string{completed, failed, pending} {
+		post(t, srv.URL+"/payments", `{"correlationId": "`+id+`", "amount": 10.50}`)
+	}
+	before := time.Now().Add(-time.Minute)
+	complete(t, store, completed, p.DefaultProcessor)
+	deadLetter(t, store, failed)
+	after := time.Now().Add(time.Minute)
+
+	one := Service{TotalRequests: 1, TotalAmount: 10_50}
+	window := func(from, to time.Time) string {
+		return "&from=" + url.QueryEscape(from.UTC().Format(time.RFC3339Nano)) + "&to=" + url.QueryEscape(to.UTC().Format(time.RFC3339Nano))
+	}
+	for _, tc := range []struct {
+		query                      string
+		def, done, dead, remaining Service
+	}{
+		{"basis=requested", one, one, one, one},
+		{"basis=processed", one, one, one, Service{}},
+		{"basis=processed" + window(before, after), one, one, one, Service{}},
+		{"basis=processed" + window(after, after.Add(time.Hour)), Service{}, Service{}, Service{}, Service{}},
+	} {
+		summary := SummaryResponse{}
+		if code := getJSON(t, srv.URL+"/payments-summary?breakdown=status&"+tc.query, &summary); code != http.StatusOK {
+			t.Fatalf("%v: status %v", tc.query, code)
+		}
+		statuses := summary.Statuses
+		if summary.Default != tc.def || statuses[db.StatusCompleted][p.DefaultProcessor] != tc.done ||
+			statuses[db.StatusFailed]["none"] != tc.dead || statuses[db.StatusPending]["none"] != tc.remaining {
+			t.Errorf("%v: default %+v, statuses %+v", tc.query, summary.Default, statuses)
+		}
+		if len(statuses) != len(db.PaymentStatuses) {
+			t.Errorf("%v: statuses %v, want every status", tc.query, statuses)
+		}
+	}
+}
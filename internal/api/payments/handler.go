@@ -1,22 +1,29 @@
 package payments
 
 import (
-	"fmt"
+	"errors"
+	"io"
+	"log/slog"
 	"net/http"
-	"strings"
 	"time"
 
 	cr "rinha/internal/api/common_responses"
 	db "rinha/internal/database"
+	"rinha/internal/logging"
 
 	p "rinha/pkg/protocol"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
-	"github.com/jackc/pgx/v5"
 )
 
-type PaymentHandler struct{}
+type PaymentHandler struct {
+	store db.Store
+}
+
+func NewPaymentHandler(store db.Store) *PaymentHandler {
+	return &PaymentHandler{store: store}
+}
 
 // POST /payments
 // {
@@ -30,7 +37,11 @@ type PaymentHandler struct{}
 func (ph *PaymentHandler) createPayment(r *http.Request, w http.ResponseWriter) {
 	data := &PaymentRequest{}
 	if bindError := render.Bind(r, data); bindError != nil {
-		fmt.Println(bindError.Error())
+		if fieldErrs, ok := p.FieldErrors(bindError); ok {
+			render.Render(w, r, cr.ErrValidation(fieldErrs))
+			return
+		}
+		slog.DebugContext(r.Context(), "invalid request body", "path", r.URL.Path, "err", bindError)
 		render.Render(w, r, cr.ErrInvalidRequest("failed to parse payment."))
 		return
 	}
@@ -38,13 +49,33 @@ func (ph *PaymentHandler) createPayment(r *http.Request, w http.ResponseWriter)
 	payment := data.Payment
 
 	// trigger sends notification to listeners
-	_, err := db.Pgxpool.Exec(db.PgxCtx, `
-                    INSERT INTO payments VALUES ($1, $2, NOW(), default)`,
-		payment.CorrelationId, payment.Amount)
+	err := ph.store.InsertPayment(r.Context(), payment)
+
+	if errors.Is(err, db.ErrDuplicate) {
+		ph.resubmittedPayment(r, w, payment)
+		return
+	}
 
 	if err != nil {
-		fmt.Println("err: ", err.Error())
-		render.Render(w, r, cr.ErrServerInternal())
+		storeError(w, r, err)
+		return
+	}
+
+	render.Render(w, r, cr.SuccessCreated())
+}
+
+// same correlationId and amount is a client retry and gets the original
+// answer back, a different amount is a conflicting payment
+func (ph *PaymentHandler) resubmittedPayment(r *http.Request, w http.ResponseWriter, payment *p.Payment) {
+	stored, err := ph.store.GetPayment(r.Context(), payment.CorrelationId)
+
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	if stored.Amount != payment.Amount {
+		render.Render(w, r, cr.ErrConflict("payment already exists with a different amount."))
 		return
 	}
 
@@ -66,40 +97,42 @@ func (ph *PaymentHandler) createPayment(r *http.Request, w http.ResponseWriter)
 func (ph *PaymentHandler) processPayment(r *http.Request, w http.ResponseWriter) {
 	data := &PaymentProcessRequest{}
 	if bindError := render.Bind(r, data); bindError != nil {
-		fmt.Println(bindError.Error())
+		if fieldErrs, ok := p.FieldErrors(bindError); ok {
+			render.Render(w, r, cr.ErrValidation(fieldErrs))
+			return
+		}
+		slog.DebugContext(r.Context(), "invalid request body", "path", r.URL.Path, "err", bindError)
 		render.Render(w, r, cr.ErrInvalidRequest("failed to parse payment process."))
 		return
 	}
 	payment := data.Payment
-	rtx, err := db.Pgxpool.BeginTx(db.PgxCtx, pgx.TxOptions{})
+
+	stored, err := ph.store.GetPayment(r.Context(), payment.CorrelationId)
+
+	if errors.Is(err, db.ErrNotFound) {
+		slog.DebugContext(r.Context(), "payment not found", logging.CorrelationId, payment.CorrelationId)
+		render.Render(w, r, cr.ErrNotFound())
+		return
+	}
 
 	if err != nil {
-		fmt.Println("failed to start transaction: ", err.Error())
-		render.Render(w, r, cr.ErrServerInternal())
+		storeError(w, r, err)
 		return
 	}
 
-	var amount *float64
-	err = rtx.QueryRow(db.PgxCtx, "select amount from payments where correlation_id = $1", payment.CorrelationId).Scan(amount)
+	err = ph.store.UpdateAmount(r.Context(), payment.CorrelationId, payment.Amount-stored.Amount)
 
-	if err != nil {
-		rtx.Rollback(db.PgxCtx)
-		fmt.Println("correlation_id not found")
+	if errors.Is(err, db.ErrNotFound) {
+		slog.DebugContext(r.Context(), "payment not found", logging.CorrelationId, payment.CorrelationId)
 		render.Render(w, r, cr.ErrNotFound())
 		return
 	}
 
-	var id string
-	err = rtx.QueryRow(db.PgxCtx, "update table payments set amount = $2 where correlation_id = $1 returning correlation_id", payment.CorrelationId, payment.Amount-*amount).Scan(&id)
-
 	if err != nil {
-		rtx.Rollback(db.PgxCtx)
-		fmt.Println("correlation_id not found")
-		render.Render(w, r, cr.ErrNotFound())
+		storeError(w, r, err)
 		return
 	}
 
-	rtx.Commit(db.PgxCtx)
 	pay := &PaymentProcessResponse{Message: "payment processed successfully"}
 	render.Render(w, r, pay)
 }
@@ -107,65 +140,103 @@ func (ph *PaymentHandler) processPayment(r *http.Request, w http.ResponseWriter)
 // GET /payments/{id}
 
 // HTTP 200 - Ok
-//
-//	{
-//	    "correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
-//	    "amount": 19.90,
-//	    "requestedAt" : 2025-07-15T12:34:56.000Z
-//	}
+// {
+//     "correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+//     "amount": 19.90,
+//     "requestedAt" : "2025-07-15T12:34:56.000Z",
+//     "status": "completed",
+//     "service": "default",
+//     "processedAt": "2025-07-15T12:34:56.100Z",
+//     "attempts": 1,
+//     "lastError": null,
+//     "lastAttemptAt": "2025-07-15T12:34:56.010Z",
+//     "claimedAt": "2025-07-15T12:34:56.010Z"
+// }
+
 func (ph *PaymentHandler) getPayment(r *http.Request, w http.ResponseWriter) {
-	if id := chi.URLParam(r, "id"); id != "" {
-		pay := &PaymentResponse{Payment: &p.Payment{}}
-		row := db.Pgxpool.QueryRow(db.PgxCtx, `
-                         SELECT correlation_id, amount, requested_at, status
-                         FROM payments
-                         WHERE correlation_id = $1`,
-			id).Scan(&pay.CorrelationId, &pay.Amount, &pay.RequestedAt, &pay.Status)
-
-		if row != nil {
-			fmt.Println("err: ", row)
-			render.Render(w, r, cr.ErrServerInternal())
-			return
-		}
-		render.Render(w, r, pay)
+	id := chi.URLParam(r, "id")
+	if !p.IsUUID(id) {
+		render.Render(w, r, cr.ErrInvalidRequest("invalid correlationId."))
 		return
 	}
 
-	render.Render(w, r, cr.ErrNotFound())
+	pay, err := ph.store.GetPayment(r.Context(), id)
+
+	if errors.Is(err, db.ErrNotFound) {
+		render.Render(w, r, cr.ErrNotFound())
+		return
+	}
+
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	render.Render(w, r, newPaymentDetailResponse(pay))
 }
 
-func (ph *PaymentHandler) getPayments(r *http.Request, w http.ResponseWriter) {
-	rows, err := db.Pgxpool.Query(db.PgxCtx, `
-                         SELECT correlation_id, amount, requested_at, status
-                         FROM payments`)
+// GET /payments?status=completed&sort=desc&limit=100&cursor=...
+// see PaymentFilter for every filter
+
+// HTTP 200 - Ok
+// {
+//     "items": [
+//         {
+//             "correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+//             "amount": 19.90,
+//             "requestedAt" : "2025-07-15T12:34:56.000Z",
+//             "status": "completed"
+//         }
+//     ],
+//     "next": "<cursor>" // null on the last page
+// }
 
+func (ph *PaymentHandler) getPayments(r *http.Request, w http.ResponseWriter) {
+	filter, err := parsePaymentFilter(r)
 	if err != nil {
-		fmt.Println(err.Error())
-		render.Render(w, r, cr.ErrServerInternal())
+		render.Render(w, r, cr.ErrInvalidRequest(err.Error()))
 		return
 	}
-	defer rows.Close()
-	payments, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (render.Renderer, error) {
-		pay := &PaymentResponse{Payment: &p.Payment{}}
-		err := row.Scan(&pay.CorrelationId, &pay.Amount, &pay.RequestedAt, &pay.Status)
-		//fmt.Println(pay.CorrelationId)
-		//fmt.Println(pay.Amount)
-		return pay, err
+
+	// one extra row means there is a next page
+	query := *filter
+	query.Limit++
+
+	page := &PaymentListResponse{Items: []*PaymentResponse{}}
+	err = ph.store.ListPayments(r.Context(), query, func(rec *db.PaymentRecord) error {
+		page.Items = append(page.Items, newPaymentResponse(rec))
+		return nil
 	})
 
 	if err != nil {
-		fmt.Printf("CollectRows error: %v\n", err)
-		render.Render(w, r, cr.ErrServerInternal())
+		storeError(w, r, err)
 		return
 	}
 
-	if err := render.RenderList(w, r, payments); err != nil {
-		render.Render(w, r, cr.ErrRender(err))
-		return
+	if len(page.Items) > filter.Limit {
+		page.Items = page.Items[:filter.Limit]
+		last := page.Items[len(page.Items)-1]
+		next := encodeCursor(db.Cursor{RequestedAt: last.RequestedAt, CorrelationId: last.CorrelationId})
+		page.Next = &next
+	}
+
+	render.Render(w, r, page)
+}
+
+// optional RFC3339 query parameter, fractional seconds may be omitted
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
 	}
+	return time.Parse(time.RFC3339Nano, value)
 }
 
 // GET /payments-summary?from=2020-07-10T12:34:56.000Z&to=2020-07-10T12:35:56.000Z
+// optional basis=requested|processed picks the time the window applies to,
+// breakdown=status adds totals per status and service. With basis=processed
+// only settled payments count, completed ones by when they were processed and
+// failed ones by their last attempt.
 
 // HTTP 200 - Ok
 // {
@@ -176,121 +247,202 @@ func (ph *PaymentHandler) getPayments(r *http.Request, w http.ResponseWriter) {
 //     "fallback" : {
 //         "totalRequests": 423545,
 //         "totalAmount": 329347.34
+//     },
+//     "statuses": {
+//         "completed": {"default": {...}, "fallback": {...}},
+//         "pending": {"none": {...}},
+//         "processing": {},
+//         "failed": {}
 //     }
 // }
 
 func (ph *PaymentHandler) getSummary(r *http.Request, w http.ResponseWriter) {
+	window, byStatus, err := parseSummaryQuery(r)
+	if err != nil {
+		render.Render(w, r, cr.ErrInvalidRequest(err.Error()))
+		return
+	}
+
+	totals, err := ph.store.Summary(r.Context(), *window)
 
-	from := chi.URLParam(r, "from")
-	to := chi.URLParam(r, "to")
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
 
-	var parsedFrom, parsedTo time.Time
-	var err error
+	summary := SummaryResponse{
+		Default:  Service(totals[p.DefaultProcessor]),
+		Fallback: Service(totals[p.FallbackProcessor]),
+	}
 
-	if from != "" {
-		parsedFrom, err = time.Parse(time.RFC3339Nano, from)
+	if byStatus {
+		statuses, err := ph.store.SummaryByStatus(r.Context(), *window)
 		if err != nil {
-			render.Render(w, r, cr.ErrInvalidRequest("failed to parse 'from' date"))
+			storeError(w, r, err)
 			return
 		}
-	}
 
-	if to != "" {
-		parsedTo, err = time.Parse(time.RFC3339Nano, to)
-		if err != nil {
-			render.Render(w, r, cr.ErrInvalidRequest("failed to parse 'to' date"))
-			return
+		summary.Statuses = make(map[string]map[string]Service, len(statuses))
+		for status, services := range statuses {
+			summary.Statuses[status] = make(map[string]Service, len(services))
+			for service, t := range services {
+				summary.Statuses[status][service] = Service(t)
+			}
 		}
 	}
 
-	baseQuery := `
-            SELECT
-                service,
-                COUNT(*) AS total_requests,
-                SUM(amount) AS total_amount
-            FROM
-                payments
-            WHERE
-                service IS NOT NULL
-                AND status = 'completed'`
+	render.Render(w, r, &summary)
+	return
+}
+
+func (ph *PaymentHandler) delete(r *http.Request, w http.ResponseWriter) {
+
+	err := ph.store.DeleteAll(r.Context())
+	if err != nil {
+		storeError(w, r, err)
+		return
+	}
+
+	render.Render(w, r, cr.SuccessNoContent())
+}
+
+// GET /payments/failed
 
-	var conditions []string
-	var args []interface{}
-	argCounter := 1 // Inicia com 1 para os placeholders do pgx ($1, $2)
+// HTTP 200 - Ok
+// [
+//     {
+//         "correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+//         "amount": 19.90,
+//         "requestedAt" : "2025-07-15T12:34:56.000Z",
+//         "status": "failed",
+//         "service": null,
+//         "processedAt": null,
+//         "attempts": 5,
+//         "lastError": "rejected by default with status 422",
+//         "lastAttemptAt": "2025-07-15T12:35:01.000Z",
+//         "claimedAt": "2025-07-15T12:35:01.000Z"
+//     }
+// ]
 
-	if !parsedFrom.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("requested_at >= $%d", argCounter))
-		args = append(args, from)
-		argCounter++
+func (ph *PaymentHandler) getDeadLetters(r *http.Request, w http.ResponseWriter) {
+	failed, err := ph.store.DeadLetters(r.Context())
+
+	if err != nil {
+		storeError(w, r, err)
+		return
 	}
 
-	if !parsedTo.IsZero() {
-		conditions = append(conditions, fmt.Sprintf("requested_at <= $%d", argCounter))
-		args = append(args, to)
-		argCounter++
+	payments := make([]render.Renderer, len(failed))
+	for i, pay := range failed {
+		payments[i] = newPaymentDetailResponse(pay)
 	}
 
-	finalQuery := baseQuery
-	if len(conditions) > 0 {
-		finalQuery += " AND " + strings.Join(conditions, " AND ")
+	if err := render.RenderList(w, r, payments); err != nil {
+		render.Render(w, r, cr.ErrRender(err))
+		return
 	}
+}
+
+// POST /payments/{id}/requeue
 
-	finalQuery += " GROUP BY service"
+// HTTP 200 - Ok
+// {
+//     "requeued": 1
+// }
 
-	rows, err := db.Pgxpool.Query(db.PgxCtx, finalQuery, args...)
+func (ph *PaymentHandler) requeuePayment(r *http.Request, w http.ResponseWriter) {
+	id := chi.URLParam(r, "id")
+	if !p.IsUUID(id) {
+		render.Render(w, r, cr.ErrInvalidRequest("invalid correlationId."))
+		return
+	}
 
+	// back to the queue with a fresh attempt count
+	n, err := ph.store.Requeue(r.Context(), []string{id})
 	if err != nil {
-		fmt.Println(err.Error())
-		render.Render(w, r, cr.ErrServerInternal())
+		storeError(w, r, err)
 		return
 	}
 
-	defer rows.Close()
+	if n == 0 {
+		render.Render(w, r, cr.ErrNotFound())
+		return
+	}
 
-	summ, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (PaymentSummaryRow, error) {
-		p := PaymentSummaryRow{}
-		err = row.Scan(&p.Name, &p.Metric.TotalRequests, &p.Metric.TotalAmount)
-		return p, err
-	})
+	render.Render(w, r, &RequeueResponse{Requeued: n})
+}
 
-	if err != nil {
-		fmt.Printf("CollectRows error: %v\n", err)
-		render.Render(w, r, cr.ErrServerInternal())
+// POST /payments/failed/requeue
+// {
+//     "correlationIds": ["4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3"]
+// }
+
+// HTTP 200 - Ok
+// {
+//     "requeued": 1
+// }
+
+func (ph *PaymentHandler) requeuePayments(r *http.Request, w http.ResponseWriter) {
+	data := &RequeueRequest{}
+	// no body requeues every dead-lettered payment
+	if bindError := render.Bind(r, data); bindError != nil && !errors.Is(bindError, io.EOF) {
+		slog.DebugContext(r.Context(), "invalid request body", "path", r.URL.Path, "err", bindError)
+		render.Render(w, r, cr.ErrInvalidRequest("failed to parse requeue request."))
 		return
 	}
 
-	summary := SummaryResponse{}
+	for _, id := range data.CorrelationIds {
+		if !p.IsUUID(id) {
+			render.Render(w, r, cr.ErrInvalidRequest("invalid correlationIds."))
+			return
+		}
+	}
 
-	if len(summ) == 0 {
-		summary.Default = Service{TotalRequests: 0, TotalAmount: 0}
-		summary.Fallback = summary.Default
-	} else if len(summ) == 1 {
-		summary.Default = summ[0].Metric
-		summary.Fallback = Service{TotalRequests: 0, TotalAmount: 0}
-	} else {
-		summary.Default = summ[0].Metric
-		summary.Fallback = summ[1].Metric
+	n, err := ph.store.Requeue(r.Context(), data.CorrelationIds)
+	if err != nil {
+		storeError(w, r, err)
+		return
 	}
 
-	render.Render(w, r, &summary)
-	return
+	render.Render(w, r, &RequeueResponse{Requeued: n})
 }
 
-func (ph *PaymentHandler) delete(r *http.Request, w http.ResponseWriter) {
+// GET /payments/{id}/events
 
-	_, err := db.Pgxpool.Exec(db.PgxCtx, "DELETE FROM processing_metrics")
-	if err != nil {
-		fmt.Println("err: ", err.Error())
-		render.Render(w, r, cr.ErrServerInternal())
+// HTTP 200 - Ok
+// [
+//     {"event": "accepted", "createdAt": "2025-07-15T12:34:56.000Z"},
+//     {"event": "claimed", "detail": "attempt 1", "createdAt": "2025-07-15T12:34:56.010Z"},
+//     {"event": "sent", "service": "default", "statusCode": 200, "latencyMs": 12.5, "createdAt": "2025-07-15T12:34:56.023Z"},
+//     {"event": "completed", "service": "default", "createdAt": "2025-07-15T12:34:56.024Z"}
+// ]
+
+func (ph *PaymentHandler) getPaymentEvents(r *http.Request, w http.ResponseWriter) {
+	id := chi.URLParam(r, "id")
+	if !p.IsUUID(id) {
+		render.Render(w, r, cr.ErrInvalidRequest("invalid correlationId."))
+		return
+	}
+
+	history, err := ph.store.Events(r.Context(), id)
+
+	if errors.Is(err, db.ErrNotFound) {
+		render.Render(w, r, cr.ErrNotFound())
 		return
 	}
 
-	_, err = db.Pgxpool.Exec(db.PgxCtx, "DELETE FROM payments")
 	if err != nil {
-		fmt.Println("err: ", err.Error())
-		render.Render(w, r, cr.ErrServerInternal())
+		storeError(w, r, err)
 		return
 	}
 
-	render.Render(w, r, cr.SuccessNoContent())
+	events := make([]render.Renderer, len(history))
+	for i, ev := range history {
+		events[i] = newPaymentEventResponse(ev)
+	}
+
+	if err := render.RenderList(w, r, events); err != nil {
+		render.Render(w, r, cr.ErrRender(err))
+		return
+	}
 }
@@ -0,0 +1,424 @@
+package payments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rinha/internal/config"
+	db "rinha/internal/database"
+	p "rinha/pkg/protocol"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *db.MemoryStore) {
+	t.Helper()
+
+	store := db.NewMemoryStore()
+	return serve(t, store), store
+}
+
+func serve(t *testing.T, store db.Store) *httptest.Server {
+	t.Helper()
+
+	r := chi.NewRouter()
+	NewRouter(r, store, config.Default().Timeouts, false)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// a store whose reads fail, for the error paths
+type brokenStore struct {
+	*db.MemoryStore
+}
+
+func (bs brokenStore) GetPayment(ctx context.Context, id string) (*db.PaymentRecord, error) {
+	return nil, errors.New("connection reset")
+}
+
+func post(t *testing.T, url string, body string) *http.Response {
+	t.Helper()
+
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestCreatePaymentIsIdempotent(t *testing.T) {
+	srv, _ := newTestServer(t)
+	const payment = `{"correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", "amount": 19.90}`
+
+	for _, tc := range []struct {
+		body   string
+		status int
+	}{
+		{payment, http.StatusCreated},
+		{payment, http.StatusCreated}, // client retry
+		{`{"correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", "amount": 20}`, http.StatusConflict},
+		{`{"correlationId": "not-an-uuid", "amount": 19.90}`, http.StatusUnprocessableEntity},
+		{`{"amount": 19.90}`, http.StatusBadRequest},
+		{`{"correlationId": "7dac24eb-a059-4a2a-9d4c-70f4fa0293e6"}`, http.StatusBadRequest},
+		{`{"correlationId": "7dac24eb-a059-4a2a-9d4c-70f4fa0293e6", "amount": 0}`, http.StatusUnprocessableEntity},
+	} {
+		if resp := post(t, srv.URL+"/payments", tc.body); resp.StatusCode != tc.status {
+			t.Errorf("POST /payments %s: status %v, want %v", tc.body, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+// amounts json decoding rejects are reported on the amount field too
+func TestCreatePaymentReportsAmountErrors(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	for _, amount := range []string{`"abc"`, `"19.90"`, `1e400`, `92233720368547758.08`, `0.001`, `true`} {
+		body := `{"correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", "amount": ` + amount + `}`
+		resp := post(t, srv.URL+"/payments", body)
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Errorf("amount %s: status %v, want %v", amount, resp.StatusCode, http.StatusUnprocessableEntity)
+			continue
+		}
+		var errs struct {
+			Errors p.ValidationErrors `json:"errors"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errs); err != nil {
+			t.Fatal(err)
+		}
+		if len(errs.Errors) != 1 || errs.Errors[0].Field != "amount" || errs.Errors[0].Code != p.Invalid {
+			t.Errorf("amount %s: errors %+v, want an invalid amount", amount, errs.Errors)
+		}
+	}
+}
+
+func TestSummaryCountsCompletedPayments(t *testing.T) {
+	srv, store := newTestServer(t)
+
+	ids := []string{
+		"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+		"5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4",
+		"6c9b13da-9f48-4f1f-8c3b-6fe3e9e182d5",
+	}
+	for _, id := range ids {
+		post(t, srv.URL+"/payments", `{"correlationId": "`+id+`", "amount": 10.50}`)
+	}
+	complete(t, store, ids[0], p.DefaultProcessor)
+	complete(t, store, ids[1], p.FallbackProcessor)
+
+	resp, err := http.Get(srv.URL + "/payments-summary?breakdown=status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	summary := SummaryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+
+	want := Service{TotalRequests: 1, TotalAmount: 10_50}
+	if summary.Default != want || summary.Fallback != want {
+		t.Errorf("summary default %+v fallback %+v, want %+v each", summary.Default, summary.Fallback, want)
+	}
+	if pending := summary.Statuses[db.StatusPending]["none"]; pending != want {
+		t.Errorf("pending %+v, want %+v", pending, want)
+	}
+}
+
+func TestListPaymentsPagesThroughNext(t *testing.T) {
+	srv, _ := newTestServer(t)
+
+	ids := []string{
+		"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+		"5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4",
+		"6c9b13da-9f48-4f1f-8c3b-6fe3e9e182d5",
+	}
+	for _, id := range ids {
+		post(t, srv.URL+"/payments", `{"correlationId": "`+id+`", "amount": 10.50}`)
+	}
+
+	var seen []string
+	url := srv.URL + "/payments?sort=asc&limit=2"
+	for pages := 0; ; pages++ {
+		if pages == len(ids) {
+			t.Fatalf("still paging after %v pages", pages)
+		}
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page struct {
+			Items []struct {
+				CorrelationId string `json:"correlationId"`
+			} `json:"items"`
+			Next *string `json:"next"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range page.Items {
+			seen = append(seen, item.CorrelationId)
+		}
+		if page.Next == nil {
+			break
+		}
+		url = srv.URL + "/payments?sort=asc&limit=2&cursor=" + *page.Next
+	}
+
+	if strings.Join(seen, ",") != strings.Join(ids, ",") {
+		t.Errorf("paged through %v, want %v", seen, ids)
+	}
+}
+
+func getJSON(t *testing.T, url string, v any) int {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// claimed and completed on service, as the listener does
+func complete(t *testing.T, store *db.MemoryStore, id string, service string) {
+	t.Helper()
+
+	claimed, err := store.ClaimNext(t.Context(), id, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkCompleted(t.Context(), id, claimed.ClaimedAt, service); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// claimed and moved to the dead-letter state, as the listener does
+func deadLetter(t *testing.T, store *db.MemoryStore, id string) {
+	t.Helper()
+
+	claimed, err := store.ClaimNext(t.Context(), id, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkFailed(t.Context(), id, claimed.ClaimedAt, "rejected by default with status 400"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func status(t *testing.T, store *db.MemoryStore, id string) string {
+	t.Helper()
+
+	rec, err := store.GetPayment(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.Status
+}
+
+func TestRequeueDeadLetters(t *testing.T) {
+	srv, store := newTestServer(t)
+
+	failed := []string{
+		"4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3",
+		"5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4",
+		"6c9b13da-9f48-4f1f-8c3b-6fe3e9e182d5",
+	}
+	const pending = "7dac24eb-a059-4a2a-9d4c-70f4fa0293e6"
+	for _, id := range append(failed, pending) {
+		post(t, srv.URL+"/payments", `{"correlationId": "`+id+`", "amount": 10.50}`)
+	}
+	for _, id := range failed {
+		deadLetter(t, store, id)
+	}
+
+	var page struct {
+		Items []struct {
+			CorrelationId string `json:"correlationId"`
+			Status        string `json:"status"`
+		} `json:"items"`
+	}
+	if code := getJSON(t, srv.URL+"/payments?status=failed&sort=asc", &page); code != http.StatusOK {
+		t.Fatalf("GET /payments?status=failed: status %v", code)
+	}
+	var listed []string
+	for _, item := range page.Items {
+		listed = append(listed, item.CorrelationId)
+	}
+	if strings.Join(listed, ",") != strings.Join(failed, ",") {
+		t.Errorf("failed payments %v, want %v", listed, failed)
+	}
+
+	var deadLetters []struct {
+		CorrelationId string  `json:"correlationId"`
+		Attempts      int     `json:"attempts"`
+		LastError     *string `json:"lastError"`
+	}
+	if code := getJSON(t, srv.URL+"/payments/failed", &deadLetters); code != http.StatusOK {
+		t.Fatalf("GET /payments/failed: status %v", code)
+	}
+	if len(deadLetters) != len(failed) || deadLetters[0].LastError == nil || deadLetters[0].Attempts != 1 {
+		t.Errorf("dead letters %+v", deadLetters)
+	}
+
+	requeued := func(resp *http.Response) int64 {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("requeue: status %v", resp.StatusCode)
+		}
+		body := RequeueResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Requeued
+	}
+
+	// not dead-lettered, nothing to requeue
+	if resp := post(t, srv.URL+"/payments/"+pending+"/requeue", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("requeue of a pending payment: status %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+	if n := requeued(post(t, srv.URL+"/payments/failed/requeue", `{"correlationIds": ["`+pending+`", "`+failed[0]+`"]}`)); n != 1 {
+		t.Errorf("requeue by ids requeued %v, want only the failed one", n)
+	}
+	if got := status(t, store, failed[0]); got != db.StatusPending {
+		t.Errorf("requeued payment %v, want %v", got, db.StatusPending)
+	}
+
+	if n := requeued(post(t, srv.URL+"/payments/"+failed[1]+"/requeue", "")); n != 1 {
+		t.Errorf("requeue by id requeued %v, want 1", n)
+	}
+	if resp := post(t, srv.URL+"/payments/"+failed[1]+"/requeue", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second requeue: status %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+
+	// no body, every dead-lettered payment
+	if n := requeued(post(t, srv.URL+"/payments/failed/requeue", "")); n != 1 {
+		t.Errorf("requeue of all requeued %v, want 1", n)
+	}
+	for _, id := range append(failed, pending) {
+		if got := status(t, store, id); got != db.StatusPending {
+			t.Errorf("%v %v, want %v", id, got, db.StatusPending)
+		}
+	}
+}
+
+func TestGetPaymentErrors(t *testing.T) {
+	srv, _ := newTestServer(t)
+	post(t, srv.URL+"/payments", `{"correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", "amount": 19.90}`)
+	broken := serve(t, brokenStore{db.NewMemoryStore()})
+
+	for _, tc := range []struct {
+		url    string
+		status int
+	}{
+		{srv.URL + "/payments/4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", http.StatusOK},
+		{srv.URL + "/payments/5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4", http.StatusNotFound},
+		{srv.URL + "/payments/not-an-uuid", http.StatusBadRequest},
+		{srv.URL + "/payments/4a7901b8-7d26-4d9d-aa19", http.StatusBadRequest},
+		{broken.URL + "/payments/4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", http.StatusInternalServerError},
+	} {
+		if code := getJSON(t, tc.url, nil); code != tc.status {
+			t.Errorf("GET %v: status %v, want %v", tc.url, code, tc.status)
+		}
+	}
+
+	detail := struct {
+		CorrelationId string `json:"correlationId"`
+		Status        string `json:"status"`
+		Attempts      int    `json:"attempts"`
+	}{}
+	getJSON(t, srv.URL+"/payments/4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", &detail)
+	if detail.CorrelationId != "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3" || detail.Status != db.StatusPending || detail.Attempts != 0 {
+		t.Errorf("detail %+v, want the pending payment", detail)
+	}
+}
+
+// only an unknown payment is a 404, store failures are not
+func TestProcessPaymentErrors(t *testing.T) {
+	srv, _ := newTestServer(t)
+	post(t, srv.URL+"/payments", `{"correlationId": "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", "amount": 19.90}`)
+	broken := serve(t, brokenStore{db.NewMemoryStore()})
+
+	for _, tc := range []struct {
+		url    string
+		id     string
+		status int
+	}{
+		{srv.URL, "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", http.StatusOK},
+		{srv.URL, "5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4", http.StatusNotFound},
+		{broken.URL, "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3", http.StatusInternalServerError},
+	} {
+		body := `{"correlationId": "` + tc.id + `", "amount": 19.90, "requestedAt": "2025-07-15T12:34:56.000Z"}`
+		if resp := post(t, tc.url+"/process-payment", body); resp.StatusCode != tc.status {
+			t.Errorf("POST %v/process-payment %v: status %v, want %v", tc.url, tc.id, resp.StatusCode, tc.status)
+		}
+	}
+}
+
+// history comes back oldest first, across a dead-letter and requeue
+func TestPaymentEventsInOrder(t *testing.T) {
+	srv, store := newTestServer(t)
+	const id = "4a7901b8-7d26-4d9d-aa19-4dc1c7cf60b3"
+	post(t, srv.URL+"/payments", `{"correlationId": "`+id+`", "amount": 19.90}`)
+
+	deadLetter(t, store, id)
+	post(t, srv.URL+"/payments/"+id+"/requeue", "")
+	claimed, err := store.ClaimNext(t.Context(), id, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := db.PaymentEvent{CorrelationId: id, Event: db.EventSent, Service: p.DefaultProcessor, StatusCode: http.StatusOK, Latency: 12 * time.Millisecond}
+	if err := store.RecordEvent(t.Context(), sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.MarkCompleted(t.Context(), id, claimed.ClaimedAt, p.DefaultProcessor); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []PaymentEventResponse
+	if code := getJSON(t, srv.URL+"/payments/"+id+"/events", &events); code != http.StatusOK {
+		t.Fatalf("status %v", code)
+	}
+	want := []string{db.EventAccepted, db.EventClaimed, db.EventFailed, db.EventRequeued, db.EventClaimed, db.EventSent, db.EventCompleted}
+	var got []string
+	for i, ev := range events {
+		got = append(got, ev.Event)
+		if i > 0 && ev.CreatedAt.Before(events[i-1].CreatedAt) {
+			t.Errorf("event %v (%v) created before %v", i, ev.Event, events[i-1].Event)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("events %v, want %v", got, want)
+	}
+	if ev := events[5]; ev.StatusCode == nil || *ev.StatusCode != http.StatusOK || ev.LatencyMs == nil || *ev.LatencyMs != 12 {
+		t.Errorf("sent event %+v, want status code and latency", ev)
+	}
+
+	for _, tc := range []struct {
+		id     string
+		status int
+	}{
+		{"5b8a02c9-8e37-4e0e-bb2a-5ed2d8d071c4", http.StatusNotFound},
+		{"not-an-uuid", http.StatusBadRequest},
+	} {
+		if code := getJSON(t, srv.URL+"/payments/"+tc.id+"/events", nil); code != tc.status {
+			t.Errorf("GET /payments/%v/events: status %v, want %v", tc.id, code, tc.status)
+		}
+	}
+}
@@ -4,37 +4,64 @@ import (
 	"fmt"
 	"net/http"
 
+	"rinha/internal/config"
+	db "rinha/internal/database"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/docgen"
 )
 
-func NewRouter(r *chi.Mux, gendoc bool) *PaymentHandler {
-	handler := &PaymentHandler{}
+func NewRouter(r *chi.Mux, store db.Store, timeouts config.Timeouts, gendoc bool) *PaymentHandler {
+	handler := NewPaymentHandler(store)
 
 	// list all payments
-	r.Get("/payments", func(w http.ResponseWriter, r *http.Request) {
+	r.With(deadline(timeouts.List)).Get("/payments", func(w http.ResponseWriter, r *http.Request) {
 		handler.getPayments(r, w)
 	})
 
-	r.Get("/payments-summary", func(w http.ResponseWriter, r *http.Request) {
+	// stream every payment matching the list filters as ndjson or csv
+	r.With(deadline(timeouts.Export)).Get("/payments/export", func(w http.ResponseWriter, r *http.Request) {
+		handler.exportPayments(r, w)
+	})
+
+	r.With(deadline(timeouts.Summary)).Get("/payments-summary", func(w http.ResponseWriter, r *http.Request) {
 		handler.getSummary(r, w)
 	})
 
 	// debug payment details
-	r.Get("/payments/{id}", func(w http.ResponseWriter, r *http.Request) {
+	r.With(deadline(timeouts.Read)).Get("/payments/{id}", func(w http.ResponseWriter, r *http.Request) {
 		handler.getPayment(r, w)
 	})
 
-	r.Post("/payments", func(w http.ResponseWriter, r *http.Request) {
+	// dead-lettered payments
+	r.With(deadline(timeouts.Read)).Get("/payments/failed", func(w http.ResponseWriter, r *http.Request) {
+		handler.getDeadLetters(r, w)
+	})
+
+	// requeue every (or the given) dead-lettered payments
+	r.With(deadline(timeouts.Admin)).Post("/payments/failed/requeue", func(w http.ResponseWriter, r *http.Request) {
+		handler.requeuePayments(r, w)
+	})
+
+	r.With(deadline(timeouts.Admin)).Post("/payments/{id}/requeue", func(w http.ResponseWriter, r *http.Request) {
+		handler.requeuePayment(r, w)
+	})
+
+	// debug payment history
+	r.With(deadline(timeouts.Read)).Get("/payments/{id}/events", func(w http.ResponseWriter, r *http.Request) {
+		handler.getPaymentEvents(r, w)
+	})
+
+	r.With(deadline(timeouts.Create)).Post("/payments", func(w http.ResponseWriter, r *http.Request) {
 		handler.createPayment(r, w)
 	})
 
 	// implementado pelo payment processor, não pelo backend
-	r.Post("/process-payment", func(w http.ResponseWriter, r *http.Request) {
+	r.With(deadline(timeouts.Admin)).Post("/process-payment", func(w http.ResponseWriter, r *http.Request) {
 		handler.processPayment(r, w)
 	})
 
-	r.Delete("/delete", func(w http.ResponseWriter, r *http.Request) {
+	r.With(deadline(timeouts.Admin)).Delete("/delete", func(w http.ResponseWriter, r *http.Request) {
 		handler.delete(r, w)
 	})
 
@@ -0,0 +1,41 @@
+package payments
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	cr "rinha/internal/api/common_responses"
+
+	"github.com/go-chi/render"
+)
+
+// request context bounded by timeout
+func deadline(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if timeout <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// failed store call, a blown deadline is a 504 and a client that went away
+// gets no answer at all
+func storeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(r.Context().Err(), context.DeadlineExceeded):
+		slog.WarnContext(r.Context(), "request timed out", "method", r.Method, "path", r.URL.Path, "err", err)
+		render.Render(w, r, cr.ErrTimeout())
+	case errors.Is(r.Context().Err(), context.Canceled):
+	default:
+		slog.ErrorContext(r.Context(), "store call failed", "method", r.Method, "path", r.URL.Path, "err", err)
+		render.Render(w, r, cr.ErrServerInternal())
+	}
+}
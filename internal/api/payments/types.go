@@ -1,8 +1,9 @@
 package payments
 
 import (
-	"errors"
+	"encoding/json"
 	"net/http"
+	db "rinha/internal/database"
 	p "rinha/pkg/protocol"
 	"time"
 )
@@ -15,18 +16,29 @@ type PaymentProcessRequest struct {
 	*p.ProcessingPayment
 }
 
+// the embedded payment decodes itself, a nil one can't
+func (pay *PaymentRequest) UnmarshalJSON(b []byte) error {
+	pay.Payment = &p.Payment{}
+	return json.Unmarshal(b, pay.Payment)
+}
+
+func (pay *PaymentProcessRequest) UnmarshalJSON(b []byte) error {
+	pay.ProcessingPayment = &p.ProcessingPayment{}
+	return json.Unmarshal(b, pay.ProcessingPayment)
+}
+
 func (pay *PaymentRequest) Bind(r *http.Request) error {
 	if pay.Payment == nil {
-		return errors.New("missing required payment fields.")
+		return p.MissingPayment()
 	}
-	return nil
+	return pay.Payment.Validate()
 }
 
 func (pay *PaymentProcessRequest) Bind(r *http.Request) error {
-	if pay.Payment == nil {
-		return errors.New("missing required payment fields.")
+	if pay.ProcessingPayment == nil {
+		return p.MissingPayment()
 	}
-	return nil
+	return pay.ProcessingPayment.Validate()
 }
 
 type PaymentProcessResponse struct {
@@ -47,21 +59,124 @@ func (pr *PaymentResponse) Render(w http.ResponseWriter, r *http.Request) error
 	return nil
 }
 
-type Service struct {
-	TotalRequests int     `json:"totalRequests"`
-	TotalAmount   float64 `json:"totalAmount"`
+func newPaymentResponse(rec *db.PaymentRecord) *PaymentResponse {
+	return &PaymentResponse{
+		Payment:     &p.Payment{CorrelationId: rec.CorrelationId, Amount: rec.Amount},
+		RequestedAt: rec.RequestedAt,
+		Status:      rec.Status,
+	}
 }
 
-type PaymentSummaryRow struct {
-	Name   string
-	Metric Service
+type Service struct {
+	TotalRequests int     `json:"totalRequests"`
+	TotalAmount   p.Money `json:"totalAmount"`
 }
 
 type SummaryResponse struct {
-	Default  Service `json:"default"`
-	Fallback Service `json:"fallback"`
+	Default  Service                       `json:"default"`
+	Fallback Service                       `json:"fallback"`
+	Statuses map[string]map[string]Service `json:"statuses,omitempty"`
 }
 
 func (sr *SummaryResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
+
+// GET /payments page, next is the cursor of the following one
+type PaymentListResponse struct {
+	Items []*PaymentResponse `json:"items"`
+	Next  *string            `json:"next"`
+}
+
+func (pl *PaymentListResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// payment with its processing history
+type PaymentDetailResponse struct {
+	*PaymentResponse
+	Service       *string    `json:"service"`
+	ProcessedAt   *time.Time `json:"processedAt"`
+	Attempts      int        `json:"attempts"`
+	LastError     *string    `json:"lastError"`
+	LastAttemptAt *time.Time `json:"lastAttemptAt"`
+	ClaimedAt     *time.Time `json:"claimedAt"`
+}
+
+func (pd *PaymentDetailResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func newPaymentDetailResponse(rec *db.PaymentRecord) *PaymentDetailResponse {
+	return &PaymentDetailResponse{
+		PaymentResponse: newPaymentResponse(rec),
+		Service:         rec.Service,
+		ProcessedAt:     rec.ProcessedAt,
+		Attempts:        rec.Attempts,
+		LastError:       rec.LastError,
+		LastAttemptAt:   rec.LastAttemptAt,
+		ClaimedAt:       rec.ClaimedAt,
+	}
+}
+
+// empty correlationIds requeues every dead-lettered payment
+type RequeueRequest struct {
+	CorrelationIds []string `json:"correlationIds"`
+}
+
+func (rq *RequeueRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+type RequeueResponse struct {
+	Requeued int64 `json:"requeued"`
+}
+
+func (rq *RequeueResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// GET /payments/export row
+type ExportRecord struct {
+	CorrelationId string     `json:"correlationId"`
+	Amount        p.Money    `json:"amount"`
+	RequestedAt   time.Time  `json:"requestedAt"`
+	Status        string     `json:"status"`
+	Service       *string    `json:"service"`
+	ProcessedAt   *time.Time `json:"processedAt"`
+}
+
+func newExportRecord(rec *db.PaymentRecord) *ExportRecord {
+	return &ExportRecord{
+		CorrelationId: rec.CorrelationId,
+		Amount:        rec.Amount,
+		RequestedAt:   rec.RequestedAt,
+		Status:        rec.Status,
+		Service:       rec.Service,
+		ProcessedAt:   rec.ProcessedAt,
+	}
+}
+
+type PaymentEventResponse struct {
+	Event      string    `json:"event"`
+	Service    *string   `json:"service,omitempty"`
+	StatusCode *int      `json:"statusCode,omitempty"`
+	LatencyMs  *float64  `json:"latencyMs,omitempty"`
+	Detail     *string   `json:"detail,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+func (pe *PaymentEventResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func newPaymentEventResponse(rec *db.EventRecord) *PaymentEventResponse {
+	return &PaymentEventResponse{
+		Event:      rec.Event,
+		Service:    rec.Service,
+		StatusCode: rec.StatusCode,
+		LatencyMs:  rec.LatencyMs,
+		Detail:     rec.Detail,
+		CreatedAt:  rec.CreatedAt,
+	}
+}
@@ -1,44 +1,54 @@
 package api
 
 import (
-	"errors"
-	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 
 	pay "rinha/internal/api/payments"
+	"rinha/internal/config"
 	db "rinha/internal/database"
+	"rinha/internal/listener"
+	"rinha/internal/logging"
+	"rinha/internal/metrics"
+	"rinha/internal/tracing"
 
-	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
-	"github.com/jackc/pgx/v5/pgconn"
 )
 
-func CreateRoutes(gendoc bool) *http.Server {
+func CreateRoutes(store db.Store, l *listener.Listener, cfg *config.Config, gendoc bool) *http.Server {
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(tracing.Middleware)
+	r.Use(logging.RequestLogger(slog.Default(), cfg.RequestLogs))
+	r.Use(metrics.Instrument)
 	r.Use(render.SetContentType(render.ContentTypeJSON))
 
-	var greeting string
+	health := &HealthHandler{store: store, listener: l}
+
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		err := db.Pgxpool.QueryRow(db.PgxCtx, "select 'Hello, world!'").Scan(&greeting)
-		var pgErr *pgconn.PgError
-		if errors.As(err, &pgErr) {
-			fmt.Println(pgErr.Message) // => syntax error at end of input
-			fmt.Println(pgErr.Code)    // => 42601
-		}
+		health.hello(r, w)
+	})
 
-		w.Write([]byte(greeting))
+	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		health.healthz(r, w)
 	})
 
-	pay.NewRouter(r, gendoc)
+	r.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		health.readyz(r, w)
+	})
+
+	r.Method(http.MethodGet, "/metrics", metrics.Handler())
+
+	pay.NewRouter(r, store, cfg.Timeouts, gendoc)
 
-	server := &http.Server{Addr: ":9999", Handler: r}
+	server := &http.Server{Addr: cfg.Addr, Handler: r}
+	// kept-alive connections are still answered while shutting down
+	server.RegisterOnShutdown(func() { health.draining.Store(true) })
 
 	// start http server in non-blocking
 	go func() {
-		fmt.Println("api started :9999")
+		slog.Info("api started", "addr", cfg.Addr)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("HTTP server ListenAndServe: %v", err)
 		}
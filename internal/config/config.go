@@ -0,0 +1,379 @@
+package config
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"rinha/internal/logging"
+)
+
+// every setting of the api and the listener. Loaded from, last one wins:
+// defaults, the optional config file, environment and command line flags.
+// The config file has the environment names, one NAME=value per line.
+
+// deadline of everything a request does (queries included), 0 means only
+// the client going away cancels it
+type Timeouts struct {
+	Create  time.Duration // POST /payments
+	Read    time.Duration // GET /payments/{id}, /payments/{id}/events, /payments/failed
+	List    time.Duration // GET /payments
+	Summary time.Duration // GET /payments-summary
+	Export  time.Duration // GET /payments/export, streams so no deadline by default
+	Admin   time.Duration // requeue, delete and process-payment
+}
+
+// processor calls made for a single claimed payment
+type RetryPolicy struct {
+	MaxAttempts int           // processor calls per claimed payment
+	BaseDelay   time.Duration // first backoff, doubled every attempt
+	MaxDelay    time.Duration // backoff cap
+}
+
+type Config struct {
+	Addr            string        // api listen address
+	DatabaseUrl     string        // pgx connection string, pool_max_conns and friends included
+	ShutdownTimeout time.Duration // in-flight api requests get this long on shutdown
+	DrainTimeout    time.Duration // workers get this long to finish their payment on shutdown
+	Timeouts        Timeouts
+
+	DefaultProcessorUrl  string
+	FallbackProcessorUrl string
+	ProcessorToken       string        // X-Rinha-Token of processors /admin routes
+	ProcessorTimeout     time.Duration // how long to wait a processor answer
+	ProcessorIdleTimeout time.Duration // kept-alive processor connections closed after idling this long
+	ProcessorHTTP2       bool          // h2c (or HTTP/2 over tls) to the processors
+
+	Workers               int           // payments queue workers
+	PollInterval          time.Duration // idle worker wait for a notification before looking at the backlog
+	HealthRefreshInterval time.Duration // cached processors health refresh
+	ReaperInterval        time.Duration // how often expired leases are looked for
+	MaxAttempts           int           // processing rounds before a payment is dead-lettered
+	LeaseTimeout          time.Duration // how long a claimed payment belongs to its worker
+	Retry                 RetryPolicy
+
+	ReconcileInterval time.Duration // 0 disables the periodic reconciliation
+	ReconcileSettle   time.Duration // payments younger than this are left out of it
+
+	LogLevel    string  // debug, info, warn or error
+	LogFormat   string  // text or json
+	RequestLogs float64 // fraction of successful requests logged, 0 disables them
+
+	TraceExporter string  // none, stdout or otlp
+	TraceFile     string  // stdout exporter output file, stdout itself when empty
+	TraceEndpoint string  // otlp http collector host:port
+	TraceSample   float64 // fraction of requests traced
+}
+
+func Default() *Config {
+	return &Config{
+		Addr:            ":9999",
+		ShutdownTimeout: 5 * time.Second,
+		DrainTimeout:    10 * time.Second,
+		Timeouts: Timeouts{
+			Create:  2 * time.Second,
+			Read:    2 * time.Second,
+			List:    5 * time.Second,
+			Summary: 5 * time.Second,
+			Admin:   10 * time.Second,
+		},
+
+		ProcessorToken:       "123",
+		ProcessorTimeout:     5 * time.Second,
+		ProcessorIdleTimeout: 90 * time.Second,
+
+		Workers:               18,
+		PollInterval:          100 * time.Millisecond,
+		HealthRefreshInterval: 500 * time.Millisecond,
+		ReaperInterval:        time.Second,
+		MaxAttempts:           5,
+		LeaseTimeout:          150 * time.Second,
+		Retry: RetryPolicy{
+			MaxAttempts: 4,
+			BaseDelay:   50 * time.Millisecond,
+			MaxDelay:    time.Second,
+		},
+
+		ReconcileSettle: 10 * time.Second,
+
+		LogLevel:    "info",
+		LogFormat:   "text",
+		RequestLogs: 1,
+
+		TraceExporter: "none",
+		TraceEndpoint: "localhost:4318",
+		TraceSample:   1,
+	}
+}
+
+// environment name and command line flag of a setting
+type setting struct {
+	env  string
+	flag string
+}
+
+// registers every setting as a flag of fs, defaults taken from cfg
+func (cfg *Config) flags(fs *flag.FlagSet) []setting {
+	var settings []setting
+	str := func(p *string, env, name, usage string) {
+		fs.StringVar(p, name, *p, usage+" ("+env+")")
+		settings = append(settings, setting{env, name})
+	}
+	num := func(p *int, env, name, usage string) {
+		fs.IntVar(p, name, *p, usage+" ("+env+")")
+		settings = append(settings, setting{env, name})
+	}
+	flt := func(p *float64, env, name, usage string) {
+		fs.Float64Var(p, name, *p, usage+" ("+env+")")
+		settings = append(settings, setting{env, name})
+	}
+	boolean := func(p *bool, env, name, usage string) {
+		fs.BoolVar(p, name, *p, usage+" ("+env+")")
+		settings = append(settings, setting{env, name})
+	}
+	dur := func(p *time.Duration, env, name, usage string) {
+		fs.DurationVar(p, name, *p, usage+" ("+env+")")
+		settings = append(settings, setting{env, name})
+	}
+
+	str(&cfg.Addr, "API_ADDR", "addr", "api listen address")
+	str(&cfg.DatabaseUrl, "DB_CONNECTION_STRING", "db", "postgres connection string")
+	dur(&cfg.ShutdownTimeout, "SHUTDOWN_TIMEOUT", "shutdown-timeout", "in-flight requests deadline on shutdown")
+	dur(&cfg.DrainTimeout, "DRAIN_TIMEOUT", "drain-timeout", "in-flight payments deadline on shutdown")
+	dur(&cfg.Timeouts.Create, "API_TIMEOUT_CREATE", "timeout-create", "POST /payments deadline")
+	dur(&cfg.Timeouts.Read, "API_TIMEOUT_READ", "timeout-read", "single payment reads deadline")
+	dur(&cfg.Timeouts.List, "API_TIMEOUT_LIST", "timeout-list", "GET /payments deadline")
+	dur(&cfg.Timeouts.Summary, "API_TIMEOUT_SUMMARY", "timeout-summary", "GET /payments-summary deadline")
+	dur(&cfg.Timeouts.Export, "API_TIMEOUT_EXPORT", "timeout-export", "GET /payments/export deadline, 0 for none")
+	dur(&cfg.Timeouts.Admin, "API_TIMEOUT_ADMIN", "timeout-admin", "requeue and delete deadline")
+
+	str(&cfg.DefaultProcessorUrl, "PROCESSOR_DEFAULT_URL", "processor-default", "default processor base url")
+	str(&cfg.FallbackProcessorUrl, "PROCESSOR_FALLBACK_URL", "processor-fallback", "fallback processor base url")
+	str(&cfg.ProcessorToken, "PROCESSOR_ADMIN_TOKEN", "processor-token", "processors X-Rinha-Token")
+	dur(&cfg.ProcessorTimeout, "PROCESSOR_TIMEOUT", "processor-timeout", "processor call deadline")
+	dur(&cfg.ProcessorIdleTimeout, "PROCESSOR_IDLE_TIMEOUT", "processor-idle-timeout", "idle processor connections lifetime")
+	boolean(&cfg.ProcessorHTTP2, "PROCESSOR_HTTP2", "processor-http2", "talk HTTP/2 to the processors")
+
+	num(&cfg.Workers, "PAYMENT_WORKERS", "workers", "payments queue workers")
+	dur(&cfg.PollInterval, "PAYMENT_POLL_INTERVAL", "poll-interval", "idle worker wait before looking at pending payments")
+	dur(&cfg.HealthRefreshInterval, "HEALTH_REFRESH_INTERVAL", "health-refresh-interval", "processors health refresh")
+	dur(&cfg.ReaperInterval, "LEASE_REAPER_INTERVAL", "lease-reaper-interval", "expired leases lookup interval")
+	num(&cfg.MaxAttempts, "PAYMENT_MAX_ATTEMPTS", "max-attempts", "processing rounds before dead-lettering")
+	dur(&cfg.LeaseTimeout, "PAYMENT_LEASE_TIMEOUT", "lease-timeout", "claimed payment lease")
+	num(&cfg.Retry.MaxAttempts, "RETRY_MAX_ATTEMPTS", "retry-max-attempts", "processor calls per processing round")
+	dur(&cfg.Retry.BaseDelay, "RETRY_BASE_DELAY", "retry-base-delay", "first retry backoff")
+	dur(&cfg.Retry.MaxDelay, "RETRY_MAX_DELAY", "retry-max-delay", "retry backoff cap")
+
+	dur(&cfg.ReconcileInterval, "RECONCILE_INTERVAL", "reconcile-interval", "periodic reconciliation, 0 disables it")
+	dur(&cfg.ReconcileSettle, "RECONCILE_SETTLE", "reconcile-settle", "payments younger than this are not reconciled")
+
+	str(&cfg.LogLevel, "LOG_LEVEL", "log-level", "debug, info, warn or error")
+	str(&cfg.LogFormat, "LOG_FORMAT", "log-format", "text or json")
+	flt(&cfg.RequestLogs, "LOG_REQUESTS", "log-requests", "fraction of successful requests logged, 0 disables them")
+
+	str(&cfg.TraceExporter, "TRACE_EXPORTER", "trace-exporter", "none, stdout or otlp")
+	str(&cfg.TraceFile, "TRACE_FILE", "trace-file", "stdout exporter output file")
+	str(&cfg.TraceEndpoint, "TRACE_OTLP_ENDPOINT", "trace-otlp-endpoint", "otlp http collector host:port")
+	flt(&cfg.TraceSample, "TRACE_SAMPLE", "trace-sample", "fraction of requests traced")
+
+	return settings
+}
+
+// registers the settings in fs and parses args, fs may hold other flags too.
+// Call Validate before using it to serve.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.flags(fs)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "NAME=value settings file (CONFIG_FILE)")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// command line wins, whatever it set stays
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	values := map[string]string{}
+	if *configFile != "" {
+		var err error
+		if values, err = readFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.env); ok && value != "" {
+			values[s.env] = value
+		}
+	}
+
+	var errs []error
+	known := map[string]bool{}
+	for _, s := range settings {
+		known[s.env] = true
+	}
+	for name := range values {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("%s: unknown setting in config file", name))
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := values[s.env]
+		if !ok || explicit[s.flag] {
+			continue
+		}
+		if err := fs.Set(s.flag, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q", s.env, value))
+		}
+	}
+	return cfg, errors.Join(errs...)
+}
+
+// NAME=value lines, blank lines and # comments ignored
+func readFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	defer file.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("config file %s:%d: expected NAME=value", path, n)
+		}
+		values[strings.TrimSpace(name)] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	return values, nil
+}
+
+func validUrl(name, value string) error {
+	if value == "" {
+		return fmt.Errorf("%s is required", name)
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http(s) url, got %q", name, value)
+	}
+	return nil
+}
+
+// how long the listener waits on a store write recording a processor answer
+const StoreTimeout = 5 * time.Second
+
+// processor calls an attempt may make: the owner lookup on both processors,
+// the payment itself and, when it's answered as a duplicate, the lookup again
+const callsPerAttempt = 5
+
+// longest a worker may hold a claimed payment in one processing round: every
+// attempt makes up to callsPerAttempt calls of ProcessorTimeout each and
+// records what was answered, with the backoff cap between attempts and the
+// outcome written last
+func (cfg *Config) RoundTimeout() time.Duration {
+	attempt := callsPerAttempt*cfg.ProcessorTimeout + StoreTimeout
+	round := time.Duration(cfg.Retry.MaxAttempts)*attempt + StoreTimeout
+	for attempt := 1; attempt < cfg.Retry.MaxAttempts; attempt++ {
+		delay := cfg.Retry.BaseDelay << (attempt - 1)
+		if delay <= 0 || delay > cfg.Retry.MaxDelay {
+			delay = cfg.Retry.MaxDelay
+		}
+		round += delay
+	}
+	return round
+}
+
+// everything the api and listener need to start, every problem at once
+func (cfg *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(cfg.Addr); err != nil {
+		errs = append(errs, fmt.Errorf("API_ADDR must be host:port, got %q", cfg.Addr))
+	}
+	check(cfg.DatabaseUrl != "", "DB_CONNECTION_STRING is required")
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"API_TIMEOUT_CREATE", cfg.Timeouts.Create},
+		{"API_TIMEOUT_READ", cfg.Timeouts.Read},
+		{"API_TIMEOUT_LIST", cfg.Timeouts.List},
+		{"API_TIMEOUT_SUMMARY", cfg.Timeouts.Summary},
+		{"API_TIMEOUT_EXPORT", cfg.Timeouts.Export},
+		{"API_TIMEOUT_ADMIN", cfg.Timeouts.Admin},
+		{"RECONCILE_INTERVAL", cfg.ReconcileInterval},
+		{"RECONCILE_SETTLE", cfg.ReconcileSettle},
+	} {
+		check(d.value >= 0, "%s must not be negative", d.name)
+	}
+
+	if err := validUrl("PROCESSOR_DEFAULT_URL", cfg.DefaultProcessorUrl); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validUrl("PROCESSOR_FALLBACK_URL", cfg.FallbackProcessorUrl); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout},
+		{"DRAIN_TIMEOUT", cfg.DrainTimeout},
+		{"PROCESSOR_TIMEOUT", cfg.ProcessorTimeout},
+		{"PROCESSOR_IDLE_TIMEOUT", cfg.ProcessorIdleTimeout},
+		{"PAYMENT_POLL_INTERVAL", cfg.PollInterval},
+		{"HEALTH_REFRESH_INTERVAL", cfg.HealthRefreshInterval},
+		{"LEASE_REAPER_INTERVAL", cfg.ReaperInterval},
+		{"PAYMENT_LEASE_TIMEOUT", cfg.LeaseTimeout},
+		{"RETRY_BASE_DELAY", cfg.Retry.BaseDelay},
+		{"RETRY_MAX_DELAY", cfg.Retry.MaxDelay},
+	} {
+		check(d.value > 0, "%s must be a positive duration", d.name)
+	}
+	check(cfg.Workers >= 1, "PAYMENT_WORKERS must be at least 1")
+	check(cfg.MaxAttempts >= 1, "PAYMENT_MAX_ATTEMPTS must be at least 1")
+	check(cfg.Retry.MaxAttempts >= 1, "RETRY_MAX_ATTEMPTS must be at least 1")
+	check(cfg.Retry.BaseDelay <= cfg.Retry.MaxDelay, "RETRY_BASE_DELAY must not exceed RETRY_MAX_DELAY")
+	// must outlast a whole processing round (every retry and backoff)
+	if round := cfg.RoundTimeout(); cfg.LeaseTimeout <= round {
+		errs = append(errs, fmt.Errorf("PAYMENT_LEASE_TIMEOUT must be longer than a processing round, %v with "+
+			"RETRY_MAX_ATTEMPTS x (5 x PROCESSOR_TIMEOUT + store write) plus backoff, got %v", round, cfg.LeaseTimeout))
+	}
+
+	if _, err := logging.ParseLevel(cfg.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL: %w", err))
+	}
+	check(cfg.LogFormat == "text" || cfg.LogFormat == "json", "LOG_FORMAT must be text or json, got %q", cfg.LogFormat)
+	check(cfg.RequestLogs >= 0 && cfg.RequestLogs <= 1, "LOG_REQUESTS must be between 0 and 1")
+	check(cfg.TraceExporter == "none" || cfg.TraceExporter == "stdout" || cfg.TraceExporter == "otlp",
+		"TRACE_EXPORTER must be none, stdout or otlp, got %q", cfg.TraceExporter)
+	if cfg.TraceExporter == "otlp" {
+		if _, _, err := net.SplitHostPort(cfg.TraceEndpoint); err != nil {
+			errs = append(errs, fmt.Errorf("TRACE_OTLP_ENDPOINT must be host:port, got %q", cfg.TraceEndpoint))
+		}
+	}
+	check(cfg.TraceSample >= 0 && cfg.TraceSample <= 1, "TRACE_SAMPLE must be between 0 and 1")
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flags > env > file > defaults
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rinha.env")
+	content := "# processors\nPROCESSOR_DEFAULT_URL=http://file:8080\nPAYMENT_WORKERS=4\nPAYMENT_POLL_INTERVAL=\"250ms\"\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("PAYMENT_WORKERS", "8")
+	t.Setenv("API_ADDR", ":8080")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg, err := Load(fs, []string{"-addr", ":7070", "serve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Addr != ":7070" {
+		t.Errorf("Addr = %q, flag should win", cfg.Addr)
+	}
+	if cfg.Workers != 8 {
+		t.Errorf("Workers = %v, env should win over file", cfg.Workers)
+	}
+	if cfg.DefaultProcessorUrl != "http://file:8080" || cfg.PollInterval != 250*time.Millisecond {
+		t.Errorf("file settings not applied: %q %v", cfg.DefaultProcessorUrl, cfg.PollInterval)
+	}
+	if cfg.LeaseTimeout != Default().LeaseTimeout {
+		t.Errorf("LeaseTimeout = %v, want default", cfg.LeaseTimeout)
+	}
+	if fs.Arg(0) != "serve" {
+		t.Errorf("remaining args %v", fs.Args())
+	}
+}
+
+func TestLoadRejectsBadValues(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "rinha.env")
+	if err := os.WriteFile(file, []byte("PAYMENT_WORKRES=4\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PAYMENT_LEASE_TIMEOUT", "30")
+
+	_, err := Load(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", file})
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"PAYMENT_WORKRES", "PAYMENT_LEASE_TIMEOUT"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %v", err, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.DatabaseUrl = "postgres://localhost/rinha"
+	cfg.DefaultProcessorUrl = "http://localhost:8001"
+	cfg.FallbackProcessorUrl = "http://localhost:8002"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+
+	cfg.Addr = "9999"
+	cfg.FallbackProcessorUrl = "localhost:8002"
+	cfg.Workers = 0
+	cfg.LeaseTimeout = time.Second
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	for _, want := range []string{"API_ADDR", "PROCESSOR_FALLBACK_URL", "PAYMENT_WORKERS", "PAYMENT_LEASE_TIMEOUT"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %v", err, want)
+		}
+	}
+}
+
+// a lease shorter than a worst case round lets a second worker pay again
+func TestValidateLeaseCoversARound(t *testing.T) {
+	cfg := Default()
+	cfg.DatabaseUrl = "postgres://localhost/rinha"
+	cfg.DefaultProcessorUrl = "http://localhost:8001"
+	cfg.FallbackProcessorUrl = "http://localhost:8002"
+
+	// 4 attempts x (5 calls x 5s + 5s event write), 5s outcome write, plus
+	// 50ms + 100ms + 200ms of backoff
+	if round := cfg.RoundTimeout(); round != 125*time.Second+350*time.Millisecond {
+		t.Errorf("RoundTimeout() = %v", round)
+	}
+
+	cfg.LeaseTimeout = 120 * time.Second
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "PAYMENT_LEASE_TIMEOUT") {
+		t.Errorf("lease of %v accepted, round takes %v: %v", cfg.LeaseTimeout, cfg.RoundTimeout(), err)
+	}
+
+	cfg.Retry.MaxAttempts = 3
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("lease of %v rejected, round takes %v: %v", cfg.LeaseTimeout, cfg.RoundTimeout(), err)
+	}
+}
@@ -0,0 +1,35 @@
+package configtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"rinha/internal/config"
+)
+
+// default config pointed at test processors, shared by the listener tests
+// inside and outside the listener package
+
+// serves defaultProcessor and fallbackProcessor, a nil one answers 404 to
+// everything. Servers are closed at the end of the test.
+func WithProcessors(t testing.TB, defaultProcessor, fallbackProcessor http.Handler) *config.Config {
+	t.Helper()
+
+	cfg := config.Default()
+	for _, proc := range []struct {
+		url     *string
+		handler http.Handler
+	}{
+		{&cfg.DefaultProcessorUrl, defaultProcessor},
+		{&cfg.FallbackProcessorUrl, fallbackProcessor},
+	} {
+		if proc.handler == nil {
+			proc.handler = http.NotFoundHandler()
+		}
+		srv := httptest.NewServer(proc.handler)
+		t.Cleanup(srv.Close)
+		*proc.url = srv.URL
+	}
+	return cfg
+}
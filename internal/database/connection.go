@@ -3,38 +3,31 @@ package db
 import (
 	"context"
 	"fmt"
-	"os"
+	"log/slog"
+
+	"rinha/internal/tracing"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var PgxCtx context.Context
-
-var Pgxpool *pgxpool.Pool
+// open a pool and make sure postgres answers
+func Connect(ctx context.Context, connString string) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
+	}
+	// span per query of traced payments
+	cfg.ConnConfig.Tracer = tracing.QueryTracer{}
 
-func Connect() {
-	PgxCtx = context.Background()
-	pool, err := pgxpool.New(PgxCtx, os.Getenv("DB_CONNECTION_STRING"))
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to create connection pool: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("unable to create connection pool: %w", err)
 	}
-	Pgxpool = pool
-	pingErr := Pgxpool.Ping(PgxCtx)
-	if pingErr != nil {
-		fmt.Fprintf(os.Stderr, "Unable to acquire connection pool: %v\n", pingErr)
-		os.Exit(1)
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("unable to acquire connection pool: %w", err)
 	}
 
-	fmt.Println("postgresql connected")
-}
-
-func Disconnect() {
-	if Pgxpool != nil {
-		Pgxpool.Close()
-		fmt.Println("postgresql disconnected")
-		return
-	}
-	fmt.Fprintln(os.Stderr, "Trying to close nil connection pool")
-	os.Exit(1)
+	slog.Info("postgresql connected")
+	return pool, nil
 }
@@ -0,0 +1,30 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrNotFound  = errors.New("payment not found")
+	ErrDuplicate = errors.New("payment already exists")
+	// claim expired and the payment was reclaimed (maybe settled) meanwhile
+	ErrLeaseLost = errors.New("payment claim lost")
+)
+
+// postgres error codes mapped to store errors
+const uniqueViolation = "23505"
+
+func pgErrorCode(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// duplicated correlation_id
+func isUniqueViolation(err error) bool {
+	return pgErrorCode(err) == uniqueViolation
+}
@@ -0,0 +1,33 @@
+package db
+
+import (
+	"time"
+)
+
+// payment_events kinds
+const (
+	EventAccepted  = "accepted"  // POST /payments stored it
+	EventClaimed   = "claimed"   // a listener worker took it
+	EventSent      = "sent"      // processor call made, see status code and latency
+	EventCompleted = "completed" // owned by a processor
+	EventRequeued  = "requeued"  // back to pending
+	EventFailed    = "failed"    // dead-lettered
+	EventReclaimed = "reclaimed" // lease expired, back to pending
+)
+
+type PaymentEvent struct {
+	CorrelationId string
+	Event         string
+	Service       string        // optional
+	StatusCode    int           // optional, processor answer
+	Latency       time.Duration // optional, processor call duration
+	Detail        string        // optional
+}
+
+func (ev PaymentEvent) latencyMs() *float64 {
+	if ev.Latency <= 0 {
+		return nil
+	}
+	ms := float64(ev.Latency) / float64(time.Millisecond)
+	return &ms
+}
@@ -0,0 +1,516 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"rinha/internal/tracing"
+	p "rinha/pkg/protocol"
+)
+
+// in memory Store for tests, same semantics as the postgres one without
+// needing a database
+
+type memoryPayment struct {
+	PaymentRecord
+	leaseUntil  time.Time
+	traceParent string
+}
+
+type MemoryStore struct {
+	mu          sync.Mutex
+	payments    map[string]*memoryPayment
+	events      map[string][]*EventRecord
+	health      map[string]p.ServiceHealth
+	checkedAt   map[string]time.Time
+	subscribers map[string][]*memorySubscription
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		payments:    make(map[string]*memoryPayment),
+		events:      make(map[string][]*EventRecord),
+		health:      map[string]p.ServiceHealth{p.DefaultProcessor: {}, p.FallbackProcessor: {}},
+		checkedAt:   make(map[string]time.Time),
+		subscribers: make(map[string][]*memorySubscription),
+	}
+}
+
+func (s *MemoryStore) Close() {}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// pointers are copied so callers never share state with the store
+func (mp *memoryPayment) record() *PaymentRecord {
+	rec := mp.PaymentRecord
+	return &rec
+}
+
+func strPtr(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// caller holds mu
+func (s *MemoryStore) recordEvent(ev PaymentEvent) {
+	rec := &EventRecord{
+		Event:     ev.Event,
+		Service:   strPtr(ev.Service),
+		LatencyMs: ev.latencyMs(),
+		Detail:    strPtr(ev.Detail),
+		CreatedAt: time.Now(),
+	}
+	if ev.StatusCode != 0 {
+		rec.StatusCode = &ev.StatusCode
+	}
+	s.events[ev.CorrelationId] = append(s.events[ev.CorrelationId], rec)
+}
+
+// caller holds mu, notifications are dropped when nobody waits like pg_notify
+func (s *MemoryStore) notify(channel string, payload string) {
+	for _, sub := range s.subscribers[channel] {
+		select {
+		case sub.ch <- payload:
+		default:
+		}
+	}
+}
+
+func (s *MemoryStore) RecordEvent(ctx context.Context, ev PaymentEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordEvent(ev)
+	return nil
+}
+
+func (s *MemoryStore) InsertPayment(ctx context.Context, pay *p.Payment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.payments[pay.CorrelationId]; ok {
+		return ErrDuplicate
+	}
+	s.payments[pay.CorrelationId] = &memoryPayment{PaymentRecord: PaymentRecord{
+		CorrelationId: pay.CorrelationId,
+		Amount:        pay.Amount,
+		RequestedAt:   time.Now(),
+		Status:        StatusPending,
+	}, traceParent: tracing.TraceParent(ctx)}
+	s.recordEvent(PaymentEvent{CorrelationId: pay.CorrelationId, Event: EventAccepted})
+	s.notify(PaymentsChannel, pay.CorrelationId)
+	return nil
+}
+
+func (s *MemoryStore) GetPayment(ctx context.Context, id string) (*PaymentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pay, ok := s.payments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return pay.record(), nil
+}
+
+func (s *MemoryStore) UpdateAmount(ctx context.Context, id string, amount p.Money) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pay, ok := s.payments[id]
+	if !ok {
+		return ErrNotFound
+	}
+	pay.Amount = amount
+	return nil
+}
+
+func comparePayments(a, b *PaymentRecord) int {
+	return cmp.Or(a.RequestedAt.Compare(b.RequestedAt), cmp.Compare(a.CorrelationId, b.CorrelationId))
+}
+
+func (q *PaymentQuery) matches(pay *PaymentRecord) bool {
+	switch {
+	case q.Status != "" && pay.Status != q.Status:
+		return false
+	case q.Service != "" && (pay.Service == nil || *pay.Service != q.Service):
+		return false
+	case q.MinAmount != nil && pay.Amount < *q.MinAmount:
+		return false
+	case q.MaxAmount != nil && pay.Amount > *q.MaxAmount:
+		return false
+	case !q.From.IsZero() && pay.RequestedAt.Before(q.From):
+		return false
+	case !q.To.IsZero() && pay.RequestedAt.After(q.To):
+		return false
+	}
+
+	if q.After != nil {
+		c := comparePayments(pay, &PaymentRecord{RequestedAt: q.After.RequestedAt, CorrelationId: q.After.CorrelationId})
+		if (q.Descending && c >= 0) || (!q.Descending && c <= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *MemoryStore) ListPayments(ctx context.Context, q PaymentQuery, fn func(*PaymentRecord) error) error {
+	s.mu.Lock()
+	var matched []*PaymentRecord
+	for _, pay := range s.payments {
+		if q.matches(&pay.PaymentRecord) {
+			matched = append(matched, pay.record())
+		}
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(matched, comparePayments)
+	if q.Descending {
+		slices.Reverse(matched)
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+
+	for _, pay := range matched {
+		if err := fn(pay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processed time of a settled payment, nil for pending and processing ones
+func processedTime(pay *PaymentRecord) *time.Time {
+	switch pay.Status {
+	case StatusCompleted:
+		return pay.ProcessedAt
+	case StatusFailed:
+		return pay.LastAttemptAt
+	}
+	return nil
+}
+
+func (w SummaryWindow) contains(pay *PaymentRecord) bool {
+	at := &pay.RequestedAt
+	if w.Basis == BasisProcessed {
+		if at = processedTime(pay); at == nil {
+			return false
+		}
+	}
+	return (w.From.IsZero() || !at.Before(w.From)) && (w.To.IsZero() || !at.After(w.To))
+}
+
+func (s *MemoryStore) Summary(ctx context.Context, w SummaryWindow) (map[string]Totals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := map[string]Totals{}
+	for _, pay := range s.payments {
+		if pay.Status != StatusCompleted || pay.Service == nil || !w.contains(&pay.PaymentRecord) {
+			continue
+		}
+		totals := summary[*pay.Service]
+		totals.TotalRequests++
+		totals.TotalAmount += pay.Amount
+		summary[*pay.Service] = totals
+	}
+	return summary, nil
+}
+
+func (s *MemoryStore) SummaryByStatus(ctx context.Context, w SummaryWindow) (map[string]map[string]Totals, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make(map[string]map[string]Totals, len(PaymentStatuses))
+	for _, status := range PaymentStatuses {
+		statuses[status] = map[string]Totals{}
+	}
+
+	for _, pay := range s.payments {
+		if !w.contains(&pay.PaymentRecord) {
+			continue
+		}
+		service := "none"
+		if pay.Service != nil {
+			service = *pay.Service
+		}
+		totals := statuses[pay.Status][service]
+		totals.TotalRequests++
+		totals.TotalAmount += pay.Amount
+		statuses[pay.Status][service] = totals
+	}
+	return statuses, nil
+}
+
+func (s *MemoryStore) QueueDepth(ctx context.Context) (map[string]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	depth := make(map[string]int, len(PaymentStatuses))
+	for _, status := range PaymentStatuses {
+		depth[status] = 0
+	}
+	for _, pay := range s.payments {
+		depth[pay.Status]++
+	}
+	return depth, nil
+}
+
+func (s *MemoryStore) DeadLetters(ctx context.Context) ([]*PaymentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var failed []*PaymentRecord
+	for _, pay := range s.payments {
+		if pay.Status == StatusFailed {
+			failed = append(failed, pay.record())
+		}
+	}
+	slices.SortFunc(failed, func(a, b *PaymentRecord) int {
+		if a.LastAttemptAt == nil || b.LastAttemptAt == nil {
+			return cmp.Compare(a.CorrelationId, b.CorrelationId)
+		}
+		return b.LastAttemptAt.Compare(*a.LastAttemptAt)
+	})
+	return failed, nil
+}
+
+func (s *MemoryStore) Requeue(ctx context.Context, ids []string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	requeue := func(pay *memoryPayment) {
+		if pay == nil || pay.Status != StatusFailed {
+			return
+		}
+		pay.Status = StatusPending
+		pay.Attempts = 0
+		pay.LastError = nil
+		s.recordEvent(PaymentEvent{CorrelationId: pay.CorrelationId, Event: EventRequeued, Detail: "requeued through the API"})
+		s.notify(PaymentsChannel, pay.CorrelationId)
+		n++
+	}
+
+	if len(ids) == 0 {
+		for _, pay := range s.payments {
+			requeue(pay)
+		}
+		return n, nil
+	}
+	for _, id := range ids {
+		requeue(s.payments[id])
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) Events(ctx context.Context, id string) ([]*EventRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.payments[id]; !ok && len(s.events[id]) == 0 {
+		return nil, ErrNotFound
+	}
+	return slices.Clone(s.events[id]), nil
+}
+
+func (s *MemoryStore) DeleteAll(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.payments = make(map[string]*memoryPayment)
+	s.events = make(map[string][]*EventRecord)
+	return nil
+}
+
+type memorySubscription struct {
+	store   *MemoryStore
+	channel string
+	ch      chan string
+}
+
+func (s *MemoryStore) Subscribe(ctx context.Context, channel string) (Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sub := &memorySubscription{store: s, channel: channel, ch: make(chan string, 1024)}
+	s.subscribers[channel] = append(s.subscribers[channel], sub)
+	return sub, nil
+}
+
+func (ms *memorySubscription) Wait(ctx context.Context) (string, error) {
+	select {
+	case payload := <-ms.ch:
+		return payload, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (ms *memorySubscription) Close(ctx context.Context) error {
+	ms.store.mu.Lock()
+	defer ms.store.mu.Unlock()
+
+	ms.store.subscribers[ms.channel] = slices.DeleteFunc(ms.store.subscribers[ms.channel], func(sub *memorySubscription) bool {
+		return sub == ms
+	})
+	return nil
+}
+
+// caller holds mu
+func (s *MemoryStore) claim(pay *memoryPayment, lease time.Duration) *p.ProcessingPayment {
+	now := time.Now()
+	reclaimed := pay.ClaimedAt != nil
+	pay.Status = StatusProcessing
+	pay.Attempts++
+	pay.LastAttemptAt = &now
+	pay.ClaimedAt = &now
+	pay.leaseUntil = now.Add(lease)
+	s.recordEvent(PaymentEvent{CorrelationId: pay.CorrelationId, Event: EventClaimed, Detail: fmt.Sprintf("attempt %d", pay.Attempts)})
+
+	return &p.ProcessingPayment{
+		Payment:     &p.Payment{CorrelationId: pay.CorrelationId, Amount: pay.Amount},
+		RequestedAt: pay.RequestedAt,
+		Attempts:    pay.Attempts,
+		TraceParent: pay.traceParent,
+		ClaimedAt:   now,
+		Reclaimed:   reclaimed,
+	}
+}
+
+func (s *MemoryStore) ClaimNext(ctx context.Context, id string, lease time.Duration) (*p.ProcessingPayment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pay, ok := s.payments[id]; ok && pay.Status == StatusPending {
+		return s.claim(pay, lease), nil
+	}
+
+	// requeued payments wait one second per attempt already made
+	now := time.Now()
+	var oldest *memoryPayment
+	for _, pay := range s.payments {
+		if pay.Status != StatusPending {
+			continue
+		}
+		if pay.LastAttemptAt != nil && pay.LastAttemptAt.After(now.Add(-time.Duration(pay.Attempts)*time.Second)) {
+			continue
+		}
+		if oldest == nil || comparePayments(&pay.PaymentRecord, &oldest.PaymentRecord) < 0 {
+			oldest = pay
+		}
+	}
+	if oldest == nil {
+		return nil, nil
+	}
+	return s.claim(oldest, lease), nil
+}
+
+// caller holds mu, fn runs only while the claim made at claimedAt still
+// holds the payment
+func (s *MemoryStore) update(id string, claimedAt time.Time, fn func(*memoryPayment)) error {
+	pay, ok := s.payments[id]
+	if !ok || pay.Status != StatusProcessing || pay.ClaimedAt == nil || !pay.ClaimedAt.Equal(claimedAt) {
+		return ErrLeaseLost
+	}
+	fn(pay)
+	pay.leaseUntil = time.Time{}
+	return nil
+}
+
+func (s *MemoryStore) MarkCompleted(ctx context.Context, id string, claimedAt time.Time, service string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(id, claimedAt, func(pay *memoryPayment) {
+		now := time.Now()
+		pay.Status = StatusCompleted
+		pay.ProcessedAt = &now
+		pay.Service = &service
+		s.recordEvent(PaymentEvent{CorrelationId: id, Event: EventCompleted, Service: service})
+	})
+}
+
+func (s *MemoryStore) MarkFailed(ctx context.Context, id string, claimedAt time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(id, claimedAt, func(pay *memoryPayment) {
+		pay.Status = StatusFailed
+		pay.LastError = &reason
+		s.recordEvent(PaymentEvent{CorrelationId: id, Event: EventFailed, Detail: reason})
+	})
+}
+
+func (s *MemoryStore) Release(ctx context.Context, id string, claimedAt time.Time, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.update(id, claimedAt, func(pay *memoryPayment) {
+		pay.Status = StatusPending
+		pay.LastError = &reason
+		s.recordEvent(PaymentEvent{CorrelationId: id, Event: EventRequeued, Detail: reason})
+	})
+}
+
+func (s *MemoryStore) ReclaimExpired(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	now := time.Now()
+	for id, pay := range s.payments {
+		if pay.Status == StatusProcessing && pay.leaseUntil.Before(now) {
+			pay.Status = StatusPending
+			pay.leaseUntil = time.Time{}
+			s.recordEvent(PaymentEvent{CorrelationId: id, Event: EventReclaimed})
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) ClaimHealthCheck(ctx context.Context, service string, interval time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.health[service]; !ok {
+		return false, nil
+	}
+	if time.Since(s.checkedAt[service]) < interval {
+		return false, nil
+	}
+	s.checkedAt[service] = time.Now()
+	return true, nil
+}
+
+func (s *MemoryStore) SaveHealth(ctx context.Context, service string, health p.ServiceHealth) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.health[service]; ok {
+		s.health[service] = health
+	}
+	return nil
+}
+
+func (s *MemoryStore) LoadHealth(ctx context.Context) (map[string]p.ServiceHealth, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	health := make(map[string]p.ServiceHealth, len(s.health))
+	for service, h := range s.health {
+		health[service] = h
+	}
+	return health, nil
+}
+
+var _ Store = (*MemoryStore)(nil)
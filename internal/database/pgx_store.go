@@ -0,0 +1,632 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"rinha/internal/tracing"
+	p "rinha/pkg/protocol"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type PgxStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPgxStore(pool *pgxpool.Pool) *PgxStore {
+	return &PgxStore{pool: pool}
+}
+
+func (s *PgxStore) Close() {
+	s.pool.Close()
+	slog.Info("postgresql disconnected")
+}
+
+func (s *PgxStore) Ping(ctx context.Context) error {
+	return s.pool.Ping(ctx)
+}
+
+// pool, connection and transaction
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// append an event to the payment history
+func recordEvent(ctx context.Context, conn execer, ev PaymentEvent) error {
+	_, err := conn.Exec(ctx, `
+                INSERT INTO payment_events (correlation_id, event, service, status_code, latency_ms, detail)
+                VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, 0), $5, NULLIF($6, ''))`,
+		ev.CorrelationId, ev.Event, ev.Service, ev.StatusCode, ev.latencyMs(), ev.Detail)
+	return err
+}
+
+func (s *PgxStore) RecordEvent(ctx context.Context, ev PaymentEvent) error {
+	return recordEvent(ctx, s.pool, ev)
+}
+
+// trigger sends notification to listeners
+func (s *PgxStore) InsertPayment(ctx context.Context, pay *p.Payment) error {
+	_, err := s.pool.Exec(ctx, `
+                    WITH inserted AS (
+                        INSERT INTO payments (correlation_id, amount, requested_at, trace_parent)
+                        VALUES ($1, $2, NOW(), NULLIF($4, ''))
+                        RETURNING correlation_id
+                    )
+                    INSERT INTO payment_events (correlation_id, event)
+                    SELECT correlation_id, $3 FROM inserted`,
+		pay.CorrelationId, pay.Amount, EventAccepted, tracing.TraceParent(ctx))
+
+	if isUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// columns scanned by scanPayment
+const paymentColumns = `correlation_id, amount, requested_at, status, service,
+                         processed_at, attempts, last_error, last_attempt_at, claimed_at`
+
+func scanPayment(row pgx.Row) (*PaymentRecord, error) {
+	pay := &PaymentRecord{}
+	err := row.Scan(&pay.CorrelationId, &pay.Amount, &pay.RequestedAt, &pay.Status, &pay.Service,
+		&pay.ProcessedAt, &pay.Attempts, &pay.LastError, &pay.LastAttemptAt, &pay.ClaimedAt)
+	return pay, err
+}
+
+func (s *PgxStore) GetPayment(ctx context.Context, id string) (*PaymentRecord, error) {
+	pay, err := scanPayment(s.pool.QueryRow(ctx, `
+                         SELECT `+paymentColumns+`
+                         FROM payments
+                         WHERE correlation_id = $1`, id))
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return pay, err
+}
+
+func (s *PgxStore) UpdateAmount(ctx context.Context, id string, amount p.Money) error {
+	tag, err := s.pool.Exec(ctx, "update payments set amount = $2 where correlation_id = $1", id, amount)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// WHERE, ORDER BY and LIMIT clauses, walks the (requested_at, correlation_id)
+// index from the cursor on
+func (q *PaymentQuery) clauses() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	add := func(condition string, values ...interface{}) {
+		placeholders := make([]interface{}, len(values))
+		for i, v := range values {
+			args = append(args, v)
+			placeholders[i] = len(args)
+		}
+		conditions = append(conditions, fmt.Sprintf(condition, placeholders...))
+	}
+
+	if q.Status != "" {
+		add("status = $%d", q.Status)
+	}
+	if q.Service != "" {
+		add("service = $%d", q.Service)
+	}
+	if q.MinAmount != nil {
+		add("amount >= $%d", *q.MinAmount)
+	}
+	if q.MaxAmount != nil {
+		add("amount <= $%d", *q.MaxAmount)
+	}
+	if !q.From.IsZero() {
+		add("requested_at >= $%d", q.From)
+	}
+	if !q.To.IsZero() {
+		add("requested_at <= $%d", q.To)
+	}
+
+	order := "ASC"
+	if q.Descending {
+		order = "DESC"
+	}
+
+	if q.After != nil {
+		if q.Descending {
+			add("(requested_at, correlation_id) < ($%d, $%d)", q.After.RequestedAt, q.After.CorrelationId)
+		} else {
+			add("(requested_at, correlation_id) > ($%d, $%d)", q.After.RequestedAt, q.After.CorrelationId)
+		}
+	}
+
+	clauses := ""
+	if len(conditions) > 0 {
+		clauses = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	clauses += fmt.Sprintf(" ORDER BY requested_at %s, correlation_id %s", order, order)
+	if q.Limit > 0 {
+		clauses += fmt.Sprintf(" LIMIT %d", q.Limit)
+	}
+	return clauses, args
+}
+
+func (s *PgxStore) ListPayments(ctx context.Context, q PaymentQuery, fn func(*PaymentRecord) error) error {
+	clauses, args := q.clauses()
+	rows, err := s.pool.Query(ctx, `
+                         SELECT `+paymentColumns+`
+                         FROM payments`+clauses, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		pay, err := scanPayment(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(pay); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// processed time of a settled payment, see SummaryWindow
+const processedTimeColumn = "CASE status WHEN 'completed' THEN processed_at WHEN 'failed' THEN last_attempt_at END"
+
+// "AND column >= $1 AND column <= $2" for the given window, processed is the
+// processed time column of the queried rows
+func timeWindow(w SummaryWindow, processed string) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	argCounter := 1 // Inicia com 1 para os placeholders do pgx ($1, $2)
+	column := "requested_at"
+	if w.Basis == BasisProcessed {
+		column = processed
+		conditions = append(conditions, column+" IS NOT NULL")
+	}
+
+	if !w.From.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%s >= $%d", column, argCounter))
+		args = append(args, w.From)
+		argCounter++
+	}
+
+	if !w.To.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("%s <= $%d", column, argCounter))
+		args = append(args, w.To)
+		argCounter++
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(conditions, " AND "), args
+}
+
+func (s *PgxStore) Summary(ctx context.Context, w SummaryWindow) (map[string]Totals, error) {
+	// completed rows only, processed_at keeps idx_payments_processed_at usable
+	window, args := timeWindow(w, "processed_at")
+	rows, err := s.pool.Query(ctx, `
+            SELECT
+                service,
+                COUNT(*) AS total_requests,
+                SUM(amount) AS total_amount
+            FROM
+                payments
+            WHERE
+                service IS NOT NULL
+                AND status = 'completed'`+window+`
+            GROUP BY service`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summary := map[string]Totals{}
+	for rows.Next() {
+		var service string
+		var totals Totals
+		if err := rows.Scan(&service, &totals.TotalRequests, &totals.TotalAmount); err != nil {
+			return nil, err
+		}
+		summary[service] = totals
+	}
+	return summary, rows.Err()
+}
+
+func (s *PgxStore) SummaryByStatus(ctx context.Context, w SummaryWindow) (map[string]map[string]Totals, error) {
+	window, args := timeWindow(w, processedTimeColumn)
+	rows, err := s.pool.Query(ctx, `
+            SELECT
+                status,
+                COALESCE(service, 'none'),
+                COUNT(*) AS total_requests,
+                SUM(amount) AS total_amount
+            FROM
+                payments
+            WHERE
+                TRUE`+window+`
+            GROUP BY status, service`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := make(map[string]map[string]Totals, len(PaymentStatuses))
+	for _, status := range PaymentStatuses {
+		statuses[status] = map[string]Totals{}
+	}
+
+	for rows.Next() {
+		var status, service string
+		var totals Totals
+		if err := rows.Scan(&status, &service, &totals.TotalRequests, &totals.TotalAmount); err != nil {
+			return nil, err
+		}
+		if statuses[status] == nil {
+			statuses[status] = map[string]Totals{}
+		}
+		statuses[status][service] = totals
+	}
+	return statuses, rows.Err()
+}
+
+func (s *PgxStore) QueueDepth(ctx context.Context) (map[string]int, error) {
+	rows, err := s.pool.Query(ctx, `SELECT status, COUNT(*) FROM payments GROUP BY status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	depth := make(map[string]int, len(PaymentStatuses))
+	for _, status := range PaymentStatuses {
+		depth[status] = 0
+	}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		depth[status] = n
+	}
+	return depth, rows.Err()
+}
+
+func (s *PgxStore) DeadLetters(ctx context.Context) ([]*PaymentRecord, error) {
+	rows, err := s.pool.Query(ctx, `
+                         SELECT `+paymentColumns+`
+                         FROM payments
+                         WHERE status = 'failed'
+                         ORDER BY last_attempt_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*PaymentRecord, error) {
+		return scanPayment(row)
+	})
+}
+
+// pg_notify wakes the listeners up
+func (s *PgxStore) Requeue(ctx context.Context, ids []string) (int64, error) {
+	if ids == nil {
+		ids = []string{} // NULL array would match nothing
+	}
+	rows, err := s.pool.Query(ctx, `
+                         WITH requeued AS (
+                             UPDATE payments
+                             SET status = 'pending', attempts = 0, last_error = NULL
+                             WHERE status = 'failed'
+                             AND (cardinality($1::text[]) = 0 OR correlation_id = ANY($1::text[]::uuid[]))
+                             RETURNING correlation_id
+                         ), events AS (
+                             INSERT INTO payment_events (correlation_id, event, detail)
+                             SELECT correlation_id, $2, 'requeued through the API' FROM requeued
+                         )
+                         SELECT pg_notify($3, correlation_id::text) FROM requeued`,
+		ids, EventRequeued, PaymentsChannel)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+	}
+	return rows.CommandTag().RowsAffected(), rows.Err()
+}
+
+func (s *PgxStore) Events(ctx context.Context, id string) ([]*EventRecord, error) {
+	rows, err := s.pool.Query(ctx, `
+                         SELECT event, service, status_code, latency_ms, detail, created_at
+                         FROM payment_events
+                         WHERE correlation_id = $1
+                         ORDER BY id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (*EventRecord, error) {
+		ev := &EventRecord{}
+		err := row.Scan(&ev.Event, &ev.Service, &ev.StatusCode, &ev.LatencyMs, &ev.Detail, &ev.CreatedAt)
+		return ev, err
+	})
+	if err != nil || len(events) > 0 {
+		return events, err
+	}
+
+	var exists bool
+	err = s.pool.QueryRow(ctx, `
+                         SELECT EXISTS (SELECT 1 FROM payments WHERE correlation_id = $1)`, id).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return events, nil
+}
+
+func (s *PgxStore) DeleteAll(ctx context.Context) error {
+	if _, err := s.pool.Exec(ctx, "DELETE FROM payment_events"); err != nil {
+		return err
+	}
+	_, err := s.pool.Exec(ctx, "DELETE FROM payments")
+	return err
+}
+
+// LISTEN on a dedicated connection, held until Close
+type pgxSubscription struct {
+	conn    *pgxpool.Conn
+	channel string
+}
+
+func (s *PgxStore) Subscribe(ctx context.Context, channel string) (Subscription, error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return &pgxSubscription{conn: conn, channel: channel}, nil
+}
+
+func (ps *pgxSubscription) Wait(ctx context.Context) (string, error) {
+	not, err := ps.conn.Conn().WaitForNotification(ctx)
+	if err != nil {
+		return "", err
+	}
+	return not.Payload, nil
+}
+
+func (ps *pgxSubscription) Close(ctx context.Context) error {
+	defer ps.conn.Release()
+	_, err := ps.conn.Exec(ctx, "UNLISTEN "+pgx.Identifier{ps.channel}.Sanitize())
+	return err
+}
+
+// claimed event goes in the same transaction as the claim itself
+func commitClaim(ctx context.Context, tx pgx.Tx, pay *p.ProcessingPayment) error {
+	err := recordEvent(ctx, tx, PaymentEvent{
+		CorrelationId: pay.CorrelationId,
+		Event:         EventClaimed,
+		Detail:        fmt.Sprintf("attempt %d", pay.Attempts),
+	})
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// the claim holds a lease, once expired the payment goes back to the queue
+func (s *PgxStore) ClaimNext(ctx context.Context, id string, lease time.Duration) (*p.ProcessingPayment, error) {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pay := p.ProcessingPayment{Payment: &p.Payment{}}
+
+	if id != "" {
+		// try to claim notification payment pending order
+		// prev holds the row before the update, its claimed_at tells whether
+		// the payment was ever claimed (attempts is reset by a requeue)
+		err = tx.QueryRow(ctx, `
+                UPDATE payments
+		SET status = 'processing', attempts = payments.attempts + 1, last_attempt_at = NOW(),
+		    claimed_at = NOW(), lease_until = NOW() + $2 * INTERVAL '1 millisecond'
+		FROM (
+			SELECT correlation_id, claimed_at
+			FROM payments
+			WHERE correlation_id = $1 AND status = 'pending'
+			FOR UPDATE
+		) prev
+		WHERE payments.correlation_id = prev.correlation_id
+		RETURNING payments.correlation_id, amount, requested_at, attempts, COALESCE(trace_parent, ''),
+		          payments.claimed_at, prev.claimed_at IS NOT NULL`,
+			id, lease.Milliseconds(),
+		).Scan(&pay.CorrelationId, &pay.Amount, &pay.RequestedAt, &pay.Attempts, &pay.TraceParent, &pay.ClaimedAt, &pay.Reclaimed)
+
+		if err == nil {
+			if err := commitClaim(ctx, tx, &pay); err != nil {
+				tx.Rollback(ctx)
+				return nil, fmt.Errorf("unexpected error on commit specific job: %w", err)
+			}
+			return &pay, nil
+		}
+
+		if !errors.Is(err, pgx.ErrNoRows) {
+			tx.Rollback(ctx)
+			return nil, fmt.Errorf("unexpected error claiming specific job: %w", err)
+		}
+	}
+
+	// in case of another listener grabs notification order first, or nothing
+	// was notified, claim oldest payment pending order. Requeued payments wait
+	// one second per attempt already made before being claimed again
+	err = tx.QueryRow(ctx, `
+                UPDATE payments
+		SET status = 'processing', attempts = payments.attempts + 1, last_attempt_at = NOW(),
+		    claimed_at = NOW(), lease_until = NOW() + $1 * INTERVAL '1 millisecond'
+		FROM (
+			SELECT correlation_id, claimed_at
+			FROM payments
+			WHERE status = 'pending'
+			AND (last_attempt_at IS NULL OR last_attempt_at <= NOW() - attempts * INTERVAL '1 second')
+			ORDER BY requested_at ASC
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		) prev
+		WHERE payments.correlation_id = prev.correlation_id
+		RETURNING payments.correlation_id, amount, requested_at, attempts, COALESCE(trace_parent, ''),
+		          payments.claimed_at, prev.claimed_at IS NOT NULL`,
+		lease.Milliseconds(),
+	).Scan(&pay.CorrelationId, &pay.Amount, &pay.RequestedAt, &pay.Attempts, &pay.TraceParent, &pay.ClaimedAt, &pay.Reclaimed)
+
+	if err == nil {
+		if err := commitClaim(ctx, tx, &pay); err != nil {
+			return nil, fmt.Errorf("unexpected error claiming specific job: %w", err)
+		}
+		return &pay, nil
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		_ = tx.Commit(ctx)
+		return nil, nil
+	}
+
+	tx.Rollback(ctx)
+	return nil, fmt.Errorf("unexpected error claiming specific job: %w", err)
+}
+
+// state change and its event in a single statement, only while the claim
+// made at claimedAt still holds the payment
+func (s *PgxStore) MarkCompleted(ctx context.Context, id string, claimedAt time.Time, service string) error {
+	tag, err := s.pool.Exec(ctx, `
+                     WITH updated AS (
+                         UPDATE payments
+                         SET status = 'completed', processed_at = NOW(), service = $1, lease_until = NULL
+                         WHERE correlation_id = $2 AND status = 'processing' AND claimed_at = $4
+                         RETURNING correlation_id
+                     )
+                     INSERT INTO payment_events (correlation_id, event, service)
+                     SELECT correlation_id, $3, $1 FROM updated`, service, id, EventCompleted, claimedAt)
+	return claimHeld(tag, err)
+}
+
+func (s *PgxStore) MarkFailed(ctx context.Context, id string, claimedAt time.Time, reason string) error {
+	tag, err := s.pool.Exec(ctx, `
+                     WITH updated AS (
+                         UPDATE payments
+                         SET status = 'failed', last_error = $2, lease_until = NULL
+                         WHERE correlation_id = $1 AND status = 'processing' AND claimed_at = $4
+                         RETURNING correlation_id
+                     )
+                     INSERT INTO payment_events (correlation_id, event, detail)
+                     SELECT correlation_id, $3, $2 FROM updated`, id, reason, EventFailed, claimedAt)
+	return claimHeld(tag, err)
+}
+
+func (s *PgxStore) Release(ctx context.Context, id string, claimedAt time.Time, reason string) error {
+	tag, err := s.pool.Exec(ctx, `
+                     WITH updated AS (
+                         UPDATE payments
+                         SET status = 'pending', last_error = $2, lease_until = NULL
+                         WHERE correlation_id = $1 AND status = 'processing' AND claimed_at = $4
+                         RETURNING correlation_id
+                     )
+                     INSERT INTO payment_events (correlation_id, event, detail)
+                     SELECT correlation_id, $3, $2 FROM updated`, id, reason, EventRequeued, claimedAt)
+	return claimHeld(tag, err)
+}
+
+// one event row per updated payment, none means a stale claim
+func claimHeld(tag pgconn.CommandTag, err error) error {
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// one reclaimed event is written per payment so the count comes from the insert
+func (s *PgxStore) ReclaimExpired(ctx context.Context) (int64, error) {
+	tag, err := s.pool.Exec(ctx, `
+                WITH reclaimed AS (
+                    UPDATE payments
+                    SET status = 'pending', lease_until = NULL
+                    WHERE status = 'processing' AND lease_until < NOW()
+                    RETURNING correlation_id
+                )
+                INSERT INTO payment_events (correlation_id, event)
+                SELECT correlation_id, $1 FROM reclaimed`, EventReclaimed)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// the processor_health row works as the lock, across every instance
+func (s *PgxStore) ClaimHealthCheck(ctx context.Context, service string, interval time.Duration) (bool, error) {
+	var claimed string
+	err := s.pool.QueryRow(ctx, `
+                UPDATE processor_health
+                SET checked_at = NOW()
+                WHERE service = $1 AND checked_at <= NOW() - $2 * INTERVAL '1 millisecond'
+                RETURNING service`,
+		service, interval.Milliseconds(),
+	).Scan(&claimed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *PgxStore) SaveHealth(ctx context.Context, service string, health p.ServiceHealth) error {
+	_, err := s.pool.Exec(ctx, `
+                UPDATE processor_health
+                SET failing = $2, min_response_time = $3
+                WHERE service = $1`,
+		service, health.Failing, health.MinResponseTime)
+	return err
+}
+
+func (s *PgxStore) LoadHealth(ctx context.Context) (map[string]p.ServiceHealth, error) {
+	rows, err := s.pool.Query(ctx, `SELECT service, failing, min_response_time FROM processor_health`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	health := map[string]p.ServiceHealth{}
+	for rows.Next() {
+		var service string
+		var h p.ServiceHealth
+		if err := rows.Scan(&service, &h.Failing, &h.MinResponseTime); err != nil {
+			return nil, err
+		}
+		health[service] = h
+	}
+	return health, rows.Err()
+}
+
+var _ Store = (*PgxStore)(nil)
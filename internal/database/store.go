@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	p "rinha/pkg/protocol"
+)
+
+// payments states
+const (
+	StatusPending    = "pending"    // waiting a listener worker
+	StatusProcessing = "processing" // claimed, leased to a worker
+	StatusCompleted  = "completed"  // owned by a processor
+	StatusFailed     = "failed"     // dead-lettered
+)
+
+var PaymentStatuses = []string{StatusPending, StatusProcessing, StatusCompleted, StatusFailed}
+
+// notification channel of new and requeued payments, payload is the correlation id
+const PaymentsChannel = "payments_queue"
+
+// time the summary window applies to
+const (
+	BasisRequested = "requested"
+	BasisProcessed = "processed"
+)
+
+// payments row
+type PaymentRecord struct {
+	CorrelationId string
+	Amount        p.Money
+	RequestedAt   time.Time
+	Status        string
+	Service       *string
+	ProcessedAt   *time.Time
+	Attempts      int
+	LastError     *string
+	LastAttemptAt *time.Time
+	ClaimedAt     *time.Time
+}
+
+// payment_events row
+type EventRecord struct {
+	Event      string
+	Service    *string
+	StatusCode *int
+	LatencyMs  *float64
+	Detail     *string
+	CreatedAt  time.Time
+}
+
+type Totals struct {
+	TotalRequests int
+	TotalAmount   p.Money
+}
+
+// keyset position, last (requested_at, correlation_id) seen
+type Cursor struct {
+	RequestedAt   time.Time
+	CorrelationId string
+}
+
+// payments listing, zero values don't filter
+type PaymentQuery struct {
+	Status     string
+	Service    string
+	MinAmount  *p.Money
+	MaxAmount  *p.Money
+	From       time.Time
+	To         time.Time
+	Descending bool
+	Limit      int // 0 means no limit
+	After      *Cursor
+}
+
+// with BasisProcessed only settled payments count: completed ones when the
+// processor accepted them, failed ones at their last attempt. Pending and
+// processing payments have no processed time, window or not.
+type SummaryWindow struct {
+	Basis string // BasisRequested or BasisProcessed
+	From  time.Time
+	To    time.Time
+}
+
+// notifications of a channel
+type Subscription interface {
+	// blocks until a notification arrives, returns its payload
+	Wait(ctx context.Context) (string, error)
+	Close(ctx context.Context) error
+}
+
+// every payments query of the api and the listener
+type Store interface {
+	// ErrDuplicate when correlationId is already stored
+	InsertPayment(ctx context.Context, pay *p.Payment) error
+	// ErrNotFound when unknown
+	GetPayment(ctx context.Context, id string) (*PaymentRecord, error)
+	UpdateAmount(ctx context.Context, id string, amount p.Money) error
+	// calls fn for every matching payment, ordered by (requested_at, correlation_id)
+	ListPayments(ctx context.Context, q PaymentQuery, fn func(*PaymentRecord) error) error
+	// completed payments per service
+	Summary(ctx context.Context, w SummaryWindow) (map[string]Totals, error)
+	// payments per status and service, unassigned ones under "none"
+	SummaryByStatus(ctx context.Context, w SummaryWindow) (map[string]map[string]Totals, error)
+	// payments per status, every status present
+	QueueDepth(ctx context.Context) (map[string]int, error)
+	DeadLetters(ctx context.Context) ([]*PaymentRecord, error)
+	// failed payments back to pending, empty ids requeues all of them
+	Requeue(ctx context.Context, ids []string) (int64, error)
+	// ErrNotFound when the payment is unknown
+	Events(ctx context.Context, id string) ([]*EventRecord, error)
+	DeleteAll(ctx context.Context) error
+	Ping(ctx context.Context) error
+
+	Subscribe(ctx context.Context, channel string) (Subscription, error)
+	// claims id when it is still pending, else the oldest pending payment
+	// due for an attempt. nil when there is nothing to claim.
+	ClaimNext(ctx context.Context, id string, lease time.Duration) (*p.ProcessingPayment, error)
+	// outcomes of a claim, ErrLeaseLost once claimedAt no longer holds the
+	// payment (lease reaped and claimed again, or already settled)
+	MarkCompleted(ctx context.Context, id string, claimedAt time.Time, service string) error
+	MarkFailed(ctx context.Context, id string, claimedAt time.Time, reason string) error
+	// claimed payment back to pending
+	Release(ctx context.Context, id string, claimedAt time.Time, reason string) error
+	RecordEvent(ctx context.Context, ev PaymentEvent) error
+	// processing payments whose lease expired back to pending
+	ReclaimExpired(ctx context.Context) (int64, error)
+
+	// true when nobody checked service health within interval, the caller
+	// is then the one to check it
+	ClaimHealthCheck(ctx context.Context, service string, interval time.Duration) (bool, error)
+	SaveHealth(ctx context.Context, service string, health p.ServiceHealth) error
+	LoadHealth(ctx context.Context) (map[string]p.ServiceHealth, error)
+
+	Close()
+}
@@ -0,0 +1,298 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"rinha/internal/api"
+	"rinha/internal/api/payments"
+	"rinha/internal/config"
+	db "rinha/internal/database"
+	"rinha/internal/listener"
+	"rinha/internal/processorsim"
+	p "rinha/pkg/protocol"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// whole pipeline: POST /payments -> postgres -> pg_notify -> listener ->
+// processor stand-ins, then /payments-summary against what they received
+
+// api base url, on a free port picked in run
+var apiUrl string
+
+type testStack struct {
+	pool              *pgxpool.Pool
+	defaultProcessor  *processorsim.Processor
+	fallbackProcessor *processorsim.Processor
+}
+
+var stack *testStack
+var skipReason string
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	ctx := context.Background()
+
+	pg, err := startPostgres(ctx)
+	if err != nil {
+		skipReason = err.Error()
+		return m.Run()
+	}
+	defer pg.stop(ctx)
+
+	if err := pg.applySchema(ctx, "../../init.sql"); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to apply init.sql: %v\n", err)
+		return 1
+	}
+
+	simConfig := processorsim.DefaultConfig()
+	simConfig.HealthInterval = 0 // the listener already limits itself
+	stack = &testStack{defaultProcessor: processorsim.New(simConfig)}
+	simConfig.Fee = 0.15
+	stack.fallbackProcessor = processorsim.New(simConfig)
+
+	defaultSrv := httptest.NewServer(stack.defaultProcessor.Handler())
+	defer defaultSrv.Close()
+	fallbackSrv := httptest.NewServer(stack.fallbackProcessor.Handler())
+	defer fallbackSrv.Close()
+
+	connStr, err := withParams(pg.connStr, map[string]string{"pool_max_conns": "30"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid connection string: %v\n", err)
+		return 1
+	}
+	port, err := freePort()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "no free port for the api: %v\n", err)
+		return 1
+	}
+	cfg := config.Default()
+	cfg.Addr = fmt.Sprintf("127.0.0.1:%d", port)
+	apiUrl = "http://" + cfg.Addr
+	cfg.DatabaseUrl = connStr
+	cfg.DefaultProcessorUrl = defaultSrv.URL
+	cfg.FallbackProcessorUrl = fallbackSrv.URL
+
+	pool, err := db.Connect(ctx, cfg.DatabaseUrl)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	store := db.NewPgxStore(pool)
+	defer store.Close()
+	stack.pool = pool
+
+	l := listener.Listen(store, cfg)
+	defer l.Stop(cfg.DrainTimeout)
+	server := api.CreateRoutes(store, l, cfg, false)
+	defer server.Shutdown(ctx)
+
+	if err := waitApi(10 * time.Second); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return m.Run()
+}
+
+func waitApi(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if resp, err := http.Get(apiUrl + "/"); err == nil {
+			resp.Body.Close()
+			return nil
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("api not listening after %v", timeout)
+}
+
+// skips without postgres and starts from empty tables and healthy processors
+func setup(t *testing.T) *testStack {
+	t.Helper()
+	if stack == nil {
+		t.Skip(skipReason)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, apiUrl+"/delete", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	_, err = stack.pool.Exec(context.Background(), `UPDATE processor_health SET failing = FALSE, checked_at = '-infinity'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, proc := range []*processorsim.Processor{stack.defaultProcessor, stack.fallbackProcessor} {
+		proc.Purge()
+		proc.SetDelay(0)
+		proc.SetFailure(false, 0)
+	}
+	return stack
+}
+
+// posts n payments with random amounts, returns their total
+func postPayments(t *testing.T, n int) p.Money {
+	t.Helper()
+
+	var total p.Money
+	for range n {
+		payment := p.Payment{
+			CorrelationId: randomUUID(),
+			Amount:        p.Money(rand.IntN(100_00) + 1),
+		}
+		total += payment.Amount
+
+		body, _ := json.Marshal(payment)
+		resp, err := http.Post(apiUrl+"/payments", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST /payments: status %v", resp.StatusCode)
+		}
+	}
+	return total
+}
+
+func randomUUID() string {
+	b := make([]byte, 16)
+	for i := range b {
+		b[i] = byte(rand.UintN(256))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func getSummary(t *testing.T) payments.SummaryResponse {
+	t.Helper()
+
+	resp, err := http.Get(apiUrl + "/payments-summary?breakdown=status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	summary := payments.SummaryResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+// waits every payment to leave pending/processing
+func waitSettled(t *testing.T, n int, timeout time.Duration) payments.SummaryResponse {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		summary := getSummary(t)
+		settled := summary.Default.TotalRequests + summary.Fallback.TotalRequests
+		for _, metric := range summary.Statuses["failed"] {
+			settled += metric.TotalRequests
+		}
+		if settled == n {
+			return summary
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v of %v payments settled after %v: %+v", settled, n, timeout, summary.Statuses)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func assertMatchesProcessors(t *testing.T, s *testStack, summary payments.SummaryResponse) {
+	t.Helper()
+
+	for _, tc := range []struct {
+		service string
+		ours    payments.Service
+		proc    *processorsim.Processor
+	}{
+		{p.DefaultProcessor, summary.Default, s.defaultProcessor},
+		{p.FallbackProcessor, summary.Fallback, s.fallbackProcessor},
+	} {
+		theirs := tc.proc.Summary(time.Time{}, time.Time{})
+		if tc.ours.TotalRequests != theirs.TotalRequests || tc.ours.TotalAmount != theirs.TotalAmount {
+			t.Errorf("%v: ours %v requests %v, processor %v requests %v", tc.service,
+				tc.ours.TotalRequests, tc.ours.TotalAmount, theirs.TotalRequests, theirs.TotalAmount)
+		}
+	}
+
+	// a payment on both processors is paid twice
+	seen := map[string]bool{}
+	for _, pay := range s.defaultProcessor.Payments() {
+		seen[pay.CorrelationId] = true
+	}
+	for _, pay := range s.fallbackProcessor.Payments() {
+		if seen[pay.CorrelationId] {
+			t.Errorf("payment %v sent to both processors", pay.CorrelationId)
+		}
+	}
+}
+
+func TestSummaryMatchesProcessors(t *testing.T) {
+	s := setup(t)
+
+	const n = 100
+	total := postPayments(t, n)
+	summary := waitSettled(t, n, 30*time.Second)
+
+	assertMatchesProcessors(t, s, summary)
+	if summary.Default.TotalRequests != n {
+		t.Errorf("healthy default processor got %v of %v payments", summary.Default.TotalRequests, n)
+	}
+	if summary.Default.TotalAmount+summary.Fallback.TotalAmount != total {
+		t.Errorf("summary total %v, posted %v", summary.Default.TotalAmount+summary.Fallback.TotalAmount, total)
+	}
+}
+
+func TestFailoverWhenDefaultFails(t *testing.T) {
+	s := setup(t)
+	s.defaultProcessor.SetFailure(true, 0)
+
+	const n = 50
+	postPayments(t, n)
+	summary := waitSettled(t, n, 30*time.Second)
+
+	assertMatchesProcessors(t, s, summary)
+	if summary.Default.TotalRequests != 0 || summary.Fallback.TotalRequests != n {
+		t.Errorf("expected every payment on fallback, got default %v fallback %v",
+			summary.Default.TotalRequests, summary.Fallback.TotalRequests)
+	}
+}
+
+func TestIntermittentFailures(t *testing.T) {
+	s := setup(t)
+	s.defaultProcessor.SetFailure(false, 0.3)
+	s.fallbackProcessor.SetFailure(false, 0.3)
+
+	const n = 100
+	total := postPayments(t, n)
+	summary := waitSettled(t, n, 60*time.Second)
+
+	assertMatchesProcessors(t, s, summary)
+	if len(summary.Statuses["failed"]) > 0 {
+		t.Errorf("payments dead-lettered: %+v", summary.Statuses["failed"])
+	}
+	if summary.Default.TotalAmount+summary.Fallback.TotalAmount != total {
+		t.Errorf("summary total %v, posted %v", summary.Default.TotalAmount+summary.Fallback.TotalAmount, total)
+	}
+}
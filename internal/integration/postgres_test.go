@@ -0,0 +1,173 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// throwaway postgres for the integration tests. Either an existing server
+// given by INTEGRATION_DATABASE_URL (a scratch database is created on it) or
+// a local cluster started with initdb/pg_ctl, found in PATH or PG_BIN.
+type postgres struct {
+	dataDir  string // local cluster only
+	pgCtl    string
+	adminUrl string // maintenance database, used to create/drop the scratch one
+	database string // scratch database
+	created  bool
+	connStr  string // scratch database connection string
+}
+
+var errNoPostgres = errors.New("no postgres available, set INTEGRATION_DATABASE_URL or put initdb/pg_ctl in PATH or PG_BIN")
+
+func findPgBinary(name string) (string, error) {
+	if dir := os.Getenv("PG_BIN"); dir != "" {
+		return filepath.Join(dir, name), nil
+	}
+	return exec.LookPath(name)
+}
+
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func startPostgres(ctx context.Context) (*postgres, error) {
+	pg := &postgres{database: fmt.Sprintf("rinha_test_%d", os.Getpid())}
+
+	if url := os.Getenv("INTEGRATION_DATABASE_URL"); url != "" {
+		pg.adminUrl = url
+	} else if err := pg.initCluster(); err != nil {
+		return nil, err
+	}
+
+	conn, err := pgx.Connect(ctx, pg.adminUrl)
+	if err != nil {
+		pg.stop(ctx)
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "CREATE DATABASE "+pg.database); err != nil {
+		pg.stop(ctx)
+		return nil, err
+	}
+
+	pg.created = true
+
+	if pg.connStr, err = withParams(pg.adminUrl, map[string]string{"database": pg.database}); err != nil {
+		pg.stop(ctx)
+		return nil, err
+	}
+
+	return pg, nil
+}
+
+// connection string with params overridden, accepts both url and
+// key=value forms
+func withParams(connStr string, params map[string]string) (string, error) {
+	if !strings.HasPrefix(connStr, "postgres://") && !strings.HasPrefix(connStr, "postgresql://") {
+		for key, value := range params {
+			connStr += " " + key + "=" + value // later keys win
+		}
+		return connStr, nil
+	}
+
+	u, err := url.Parse(connStr)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for key, value := range params {
+		if key == "database" {
+			u.Path = "/" + value
+			continue
+		}
+		query.Set(key, value)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (pg *postgres) initCluster() error {
+	initdb, err := findPgBinary("initdb")
+	if err != nil {
+		return errNoPostgres
+	}
+	if pg.pgCtl, err = findPgBinary("pg_ctl"); err != nil {
+		return errNoPostgres
+	}
+	if os.Geteuid() == 0 {
+		return errors.New("postgres refuses to run as root, set INTEGRATION_DATABASE_URL instead")
+	}
+
+	if pg.dataDir, err = os.MkdirTemp("", "rinha-pg-"); err != nil {
+		return err
+	}
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command(initdb, "-D", pg.dataDir, "-U", "postgres", "--auth=trust", "-E", "UTF8").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("initdb: %w: %s", err, out)
+	}
+
+	opts := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1 -c fsync=off -c synchronous_commit=off", port, pg.dataDir)
+	out, err = exec.Command(pg.pgCtl, "-D", pg.dataDir, "-o", opts, "-l", filepath.Join(pg.dataDir, "log"), "-w", "start").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pg_ctl start: %w: %s", err, out)
+	}
+
+	pg.adminUrl = fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port)
+	return nil
+}
+
+// create the schema the same way docker-entrypoint-initdb.d does
+func (pg *postgres) applySchema(ctx context.Context, path string) error {
+	schema, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(ctx, pg.connStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	// no arguments means simple protocol, which accepts many statements at once
+	_, err = conn.Exec(ctx, string(schema))
+	return err
+}
+
+func (pg *postgres) stop(ctx context.Context) {
+	if pg.created {
+		if conn, err := pgx.Connect(ctx, pg.adminUrl); err == nil {
+			conn.Exec(ctx, "DROP DATABASE IF EXISTS "+pg.database+" WITH (FORCE)")
+			conn.Close(ctx)
+		}
+	}
+
+	if pg.dataDir != "" {
+		if pg.pgCtl != "" {
+			exec.Command(pg.pgCtl, "-D", pg.dataDir, "-m", "immediate", "stop").Run()
+		}
+		if strings.HasPrefix(filepath.Base(pg.dataDir), "rinha-pg-") {
+			os.RemoveAll(pg.dataDir)
+		}
+	}
+}
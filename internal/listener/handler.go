@@ -1,205 +1,296 @@
 package listener
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"net/http"
-	"sync/atomic"
+	"log/slog"
 	"time"
 
+	"rinha/internal/config"
 	db "rinha/internal/database"
+	"rinha/internal/logging"
+	"rinha/internal/metrics"
+	"rinha/internal/tracing"
 	prot "rinha/pkg/protocol"
 
-	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var processed atomic.Uint64
-var median atomic.Uint64
+// send payment to payment processor, retrying transient failures with
+// backoff and failing over between processors. Only a 2xx answer (or a
+// processor confirming it already has the payment) marks it as completed.
+func processPayment(ctx context.Context, services *PaymentServices, log *slog.Logger, p *prot.ProcessingPayment) (err error) {
+	// continues the trace of the request that created the payment
+	ctx, span := tracing.Tracer().Start(tracing.WithTraceParent(ctx, p.TraceParent), "payment.process",
+		trace.WithAttributes(
+			attribute.String(logging.CorrelationId, p.CorrelationId),
+			attribute.Int("payment.attempts", p.Attempts),
+			attribute.Float64("payment.queue_wait_seconds", time.Since(p.RequestedAt).Seconds()),
+		))
+	defer func() {
+		tracing.Fail(span, err)
+		span.End()
+	}()
 
-// watch and update median value based on total of processed payments
-func processedWatcher(ctx context.Context, id uint64, topic string) error {
-	conn, err := db.Pgxpool.Acquire(db.PgxCtx)
-	if err != nil {
-		return err
-	}
-	defer conn.Release()
+	// the lease must outlast the round, an event write and the outcome write
+	// past the deadline included. RoundTimeout is checked against the lease
+	// at startup, this only stops a round it didn't account for.
+	ctx, cancel := context.WithTimeout(ctx, services.leaseTimeout-2*storeTimeout)
+	defer cancel()
 
-	fmt.Printf("[ID: %v][TOPIC: %v] waiting notifications\n", id, topic)
+	service, processorUrl := services.route()
+	log = log.With(logging.CorrelationId, p.CorrelationId)
 
-	for {
-		select {
-		case <-ctx.Done():
-			fmt.Printf("stop processing topic %v\n", topic)
-			return nil
-		default:
-			nProcessed := processed.Load()
-			if nProcessed > 0 && nProcessed%10 == 0 {
-				fmt.Printf("processed count reached %d. Triggering rolling average recalculation.\n", nProcessed)
-				var latestMedian uint64
-				err := conn.QueryRow(ctx, "SELECT update_rolling_payment_average();").Scan(&latestMedian)
-				if err != nil {
-					return err
-				}
-				fmt.Printf("[ID: %v][TOPIC: %v] median: %+v\n", id, topic, latestMedian)
-				median.Store(latestMedian)
+	body, _ := json.Marshal(map[string]interface{}{
+		"correlationId": p.CorrelationId,
+		"amount":        p.Amount,
+		"requestedAt":   p.RequestedAt,
+	})
 
+	var lastErr error
+	for attempt := 1; attempt <= services.retry.maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return release(ctx, services, p, ctx.Err())
+			case <-time.After(services.retry.backoff(attempt - 1)):
 			}
-			time.Sleep(100 * time.Millisecond)
+			metrics.Retries.WithLabelValues(service).Inc()
 		}
 
-	}
-}
+		// a timed out attempt, a worker that lost its lease or a round before
+		// a requeue may have reached a processor anyway, never pay the same
+		// payment twice. Nothing is sent while that is unknown.
+		if attempt > 1 || p.Reclaimed {
+			owner, err := services.lookupOwner(ctx, p.CorrelationId)
+			if err != nil {
+				lastErr = fmt.Errorf("owner lookup failed: %w", err)
+				log.Warn("owner lookup failed", "attempt", attempt, "err", err)
+				continue
+			}
+			if owner != "" {
+				return completePayment(ctx, services.store, p, owner)
+			}
+		}
 
-// send payment to payment processor
-func processPayment(services *PaymentServices, id uint64, conn *pgxpool.Conn, p *prot.ProcessingPayment) error {
+		sendCtx, sendSpan := tracing.Tracer().Start(ctx, "processor POST /payments", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.String(logging.Service, service), attribute.Int("attempt", attempt)))
+		start := time.Now()
+		status, err := services.sendPayment(sendCtx, processorUrl, body)
+		latency := time.Since(start)
+		sendSpan.SetAttributes(attribute.Int("http.response.status_code", status))
+		tracing.Fail(sendSpan, err)
+		sendSpan.End()
+		metrics.ProcessorRequests.WithLabelValues(service, metrics.Code(status, err)).Observe(latency.Seconds())
+		sent := db.PaymentEvent{CorrelationId: p.CorrelationId, Event: db.EventSent,
+			Service: service, StatusCode: status, Latency: latency}
+		if err != nil {
+			sent.Detail = err.Error()
+		}
+		recordEvent(ctx, services.store, sent)
 
-	latestMedian := median.Load()
+		switch classify(status, err) {
+		case outcomeCompleted:
+			log.Debug("payment processed", logging.Service, service, logging.Latency, latency)
+			return completePayment(ctx, services.store, p, service)
 
-	service := "default"
-	processorUrl := *services.defaultUrl
-	if uint64(p.Amount) < latestMedian {
-		processorUrl = *services.fallbackUrl
-		service = "fallback"
+		case outcomeDuplicate:
+			// processor already knows this correlationId, record whoever owns it
+			owner, err := services.lookupOwner(ctx, p.CorrelationId)
+			if err != nil {
+				lastErr = fmt.Errorf("%v answered %v and owner lookup failed: %w", service, status, err)
+				continue
+			}
+			if owner != "" {
+				return completePayment(ctx, services.store, p, owner)
+			}
+			lastErr = fmt.Errorf("rejected by %v with status %v", service, status)
+			if err := deadLetter(ctx, services.store, p, lastErr); err != nil {
+				return err
+			}
+			return fmt.Errorf("payment %v dead-lettered: %w", p.CorrelationId, lastErr)
+
+		case outcomeRejected:
+			lastErr = fmt.Errorf("rejected by %v with status %v", service, status)
+			if err := deadLetter(ctx, services.store, p, lastErr); err != nil {
+				return err
+			}
+			return fmt.Errorf("payment %v dead-lettered: %w", p.CorrelationId, lastErr)
+		}
+
+		lastErr = err
+		if lastErr == nil {
+			lastErr = fmt.Errorf("status %v", status)
+		}
+		log.Warn("payment attempt failed", logging.Service, service, "attempt", attempt,
+			"status", status, logging.Latency, latency, "err", lastErr)
+		service, processorUrl = services.failover(service)
 	}
 
-	body, _ := json.Marshal(map[string]interface{}{
-		"correlationId": p.CorrelationId,
-		"amount":        p.Amount,
-		"requestedAt":   p.RequestedAt,
-	})
+	// aborted on shutdown or out of lease, not the payment fault
+	if ctx.Err() != nil {
+		return release(ctx, services, p, ctx.Err())
+	}
 
-	fmt.Printf("[ID: %v] processing %v URL: %v\n", id, p.CorrelationId, processorUrl)
-	resp, err := http.Post(processorUrl, "application/json", bytes.NewBuffer(body))
-	if err != nil {
+	if p.Attempts >= services.maxAttempts {
+		if err := deadLetter(ctx, services.store, p, lastErr); err != nil {
+			return err
+		}
+		return fmt.Errorf("payment %v dead-lettered after %v attempts: %w", p.CorrelationId, p.Attempts, lastErr)
+	}
+
+	// out of retries for this round, give it back to the queue
+	return release(ctx, services, p, lastErr)
+}
+
+// back to pending, claimable by any worker (or instance) again. Whatever
+// may have reached a processor is caught by the owner lookup next time.
+func release(ctx context.Context, services *PaymentServices, p *prot.ProcessingPayment, reason error) error {
+	ctx, cancel := detached(ctx)
+	defer cancel()
+	if err := services.store.Release(ctx, p.CorrelationId, p.ClaimedAt, reason.Error()); err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	metrics.PaymentsReleased.Inc()
+	return fmt.Errorf("payment %v requeued after attempt %v: %w", p.CorrelationId, p.Attempts, reason)
+}
 
-	_, err = conn.Exec(db.PgxCtx, `
-                     UPDATE payments
-                     SET status = 'completed', processed_at = NOW(), service = $1
-                     WHERE correlation_id = $2`, service, p.CorrelationId)
-	if err != nil {
+// how long recording a processor answer may take
+const storeTimeout = config.StoreTimeout
+
+// what a processor answered must be recorded even when shutting down,
+// otherwise a paid payment is sent again once its lease expires
+func detached(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), storeTimeout)
+}
+
+// payment is owned by service, it's what /payments-summary accounts for
+func completePayment(ctx context.Context, store db.Store, p *prot.ProcessingPayment, service string) error {
+	ctx, cancel := detached(ctx)
+	defer cancel()
+	if err := store.MarkCompleted(ctx, p.CorrelationId, p.ClaimedAt, service); err != nil {
 		return err
 	}
 
-	processed.Add(1)
-	fmt.Printf("[ID: %v][MEDIAN: %v] processed %+v\n", id, latestMedian, p)
+	metrics.PaymentsCompleted.WithLabelValues(service).Inc()
 	return nil
 }
 
-// returns error waiting notification if timeout exceeds
-func claimPaymentOrder(conn *pgxpool.Conn, timeout time.Duration) (*prot.ProcessingPayment, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// move payment to the dead-letter state, it's only picked up again once
+// requeued through the API
+func deadLetter(ctx context.Context, store db.Store, p *prot.ProcessingPayment, reason error) error {
+	ctx, cancel := detached(ctx)
 	defer cancel()
-	not, err := conn.Conn().WaitForNotification(ctx)
-	if err != nil {
-		return nil, err
+	if err := store.MarkFailed(ctx, p.CorrelationId, p.ClaimedAt, reason.Error()); err != nil {
+		return err
 	}
+	metrics.PaymentsDeadLettered.Inc()
+	return nil
+}
 
-	//fmt.Printf("[ID: %v][PID: %v][TOPIC: %v] payload: %+v\n", id, not.PID, not.Channel, not.Payload)
-	tx, err := conn.Begin(db.PgxCtx)
-	p := prot.ProcessingPayment{Payment: &prot.Payment{}}
-
-	// try to claim notification payment pending order
-	err = tx.QueryRow(db.PgxCtx, `
-                UPDATE payments
-		SET status = 'processing'
-		WHERE correlation_id = $1 AND status = 'pending'
-		RETURNING correlation_id, amount, requested_at`,
-		not.Payload,
-	).Scan(&p.CorrelationId, &p.Amount, &p.RequestedAt)
-
-	if err == nil {
-		if err := tx.Commit(db.PgxCtx); err != nil {
-			tx.Rollback(db.PgxCtx)
-			return nil, fmt.Errorf("unexpected error on commit specific job: %w", err)
-		}
-		return &p, nil
+// payment history is a debugging aid, failing to write it doesn't fail the payment
+func recordEvent(ctx context.Context, store db.Store, ev db.PaymentEvent) {
+	ctx, cancel := detached(ctx)
+	defer cancel()
+	if err := store.RecordEvent(ctx, ev); err != nil {
+		slog.Warn("failed to record payment event", "event", ev.Event, logging.CorrelationId, ev.CorrelationId, "err", err)
 	}
+}
 
-	if !errors.Is(err, pgx.ErrNoRows) {
-		return nil, fmt.Errorf("unexpected error claiming specific job: %w", err)
+// notifications waiting a worker, past this they are dropped and the
+// payments are claimed from the pending backlog instead
+const notifiedBuffer = 1024
+
+// one connection LISTENs for every worker, each notification goes to a
+// single worker
+func dispatchNotifications(ctx context.Context, id uint64, topic string) error {
+	services := ctx.Value("services").(*PaymentServices)
+
+	sub, err := services.store.Subscribe(ctx, db.PaymentsChannel)
+	if err != nil {
+		return err
 	}
+	defer func() {
+		ctx, cancel := detached(ctx)
+		defer cancel()
+		sub.Close(ctx)
+	}()
 
-	// in case of another listener grabs notification order first
-	// claim latest notification payment peding order
-	err = tx.QueryRow(ctx, `
-                UPDATE payments
-		SET status = 'processing'
-		WHERE correlation_id = (
-			SELECT correlation_id
-			FROM payments
-			WHERE status = 'pending'
-			ORDER BY requested_at ASC
-			FOR UPDATE SKIP LOCKED
-			LIMIT 1
-		)
-		RETURNING correlation_id, amount, requested_at`,
-	).Scan(&p.CorrelationId, &p.Amount, &p.RequestedAt)
-
-	if err == nil {
-		if err := tx.Commit(ctx); err != nil {
-			return nil, fmt.Errorf("unexpected error claiming specific job: %w", err)
+	slog.Debug("waiting notifications", logging.WorkerId, id, logging.Topic, topic)
+
+	for {
+		payload, err := sub.Wait(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				slog.Debug("stop processing topic", logging.Topic, topic)
+				return nil
+			}
+			return err
+		}
+
+		select {
+		case services.notified <- payload:
+		default:
 		}
-		return &p, nil
 	}
+}
 
-	if errors.Is(err, pgx.ErrNoRows) {
-		_ = tx.Commit(ctx)
-		return nil, nil
+// waits a notification up to timeout, when nothing is notified it still
+// looks for pending payments since requeued payments don't notify. The claim
+// holds a lease, once expired the payment goes back to the queue.
+func claimPaymentOrder(ctx context.Context, services *PaymentServices) (*prot.ProcessingPayment, error) {
+	var notified string
+	select {
+	case notified = <-services.notified:
+	case <-time.After(services.pollInterval):
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
-	return nil, fmt.Errorf("unexpected error claiming specific job: %w", err)
+	return services.store.ClaimNext(ctx, notified, services.leaseTimeout)
 }
 
-// start listening and processing new notifications
+// start processing notified and pending payments. Once ctx is done no
+// payment is claimed, the one being processed runs until services.inflight
+// is done.
 func processPaymentsQueue(ctx context.Context, id uint64, topic string) error {
 	services := ctx.Value("services").(*PaymentServices)
+	log := slog.With(logging.WorkerId, id, logging.Topic, topic)
 
-	conn, err := db.Pgxpool.Acquire(db.PgxCtx)
-	if err != nil {
-		return err
-	}
-	_, err = conn.Exec(db.PgxCtx, fmt.Sprintf("LISTEN %s", topic))
-	if err != nil {
-		return err
-	}
-
-	defer conn.Release()
-	fmt.Printf("[ID: %v][TOPIC: %v] waiting notifications\n", id, topic)
+	log.Debug("waiting payments")
 
 	for {
 		select {
 		case <-ctx.Done():
-			fmt.Printf("stop processing topic %v\n", topic)
-			_, err = conn.Exec(db.PgxCtx, fmt.Sprintf("UNLISTEN %s", topic))
-			return err
+			log.Debug("stop processing topic")
+			return nil
 		default:
-			p, err := claimPaymentOrder(conn, 100*time.Millisecond)
+			p, err := claimPaymentOrder(ctx, services)
 			if err != nil {
-				if (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) && ctx.Err() == nil {
-					//fmt.Println(err.Error())
-					//fmt.Println("listen timeout")
-					continue
+				if ctx.Err() != nil {
+					return nil
 				}
-				return err
+				log.Error("claim payment failed", "err", err)
 			}
 			if p != nil {
-				processPayment(services, id, conn, p)
+				if err := processPayment(services.inflight, services, log, p); err != nil {
+					log.Warn("payment not completed", logging.CorrelationId, p.CorrelationId, "err", err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(services.pollInterval):
 			}
-			time.Sleep(100 * time.Millisecond)
 		}
 	}
 }
 
 // subscribe all handlers
-func assignTopics() {
-	l.subscribe(1, "processed_watcher", processedWatcher)
-	l.subscribe(18, "payments_queue", processPaymentsQueue)
-	//l.subscribe(1, "health", healthChecker)
+func (l *Listener) assignTopics(workers uint64) {
+	l.subscribe(1, "health", healthChecker)
+	l.subscribe(1, "payments_notify", dispatchNotifications)
+	l.subscribe(workers, "payments_queue", processPaymentsQueue)
+	l.subscribe(1, "lease_reaper", leaseReaper)
 }
@@ -0,0 +1,192 @@
+package listener
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"rinha/internal/config/configtest"
+	db "rinha/internal/database"
+	prot "rinha/pkg/protocol"
+)
+
+// worker services against the in memory store and the given processors, a
+// nil one answers 404 to everything
+func newTestServices(t *testing.T, defaultProcessor, fallbackProcessor http.Handler) *PaymentServices {
+	t.Helper()
+
+	services := newPaymentServices(db.NewMemoryStore(), configtest.WithProcessors(t, defaultProcessor, fallbackProcessor))
+	t.Cleanup(services.client.Close)
+	return services
+}
+
+// inserted and claimed, as a worker gets it
+func claimed(t *testing.T, services *PaymentServices, id string, lease time.Duration) *prot.ProcessingPayment {
+	t.Helper()
+	if err := services.store.InsertPayment(t.Context(), &prot.Payment{CorrelationId: id, Amount: 100}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := services.store.ClaimNext(t.Context(), id, lease)
+	if err != nil || p == nil {
+		t.Fatalf("claim %v: %v, %v", id, p, err)
+	}
+	return p
+}
+
+// a worker whose lease was reaped must not settle the payment another worker
+// claimed since
+func TestStaleClaimCannotSettle(t *testing.T) {
+	services := newTestServices(t, nil, nil)
+	store := services.store
+	stale := claimed(t, services, "00000000-0000-4000-8000-000000000001", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, err := store.ReclaimExpired(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	current, err := store.ClaimNext(t.Context(), stale.CorrelationId, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := completePayment(t.Context(), store, stale, prot.DefaultProcessor); err != db.ErrLeaseLost {
+		t.Errorf("stale claim completed: %v, want %v", err, db.ErrLeaseLost)
+	}
+	if err := release(t.Context(), services, stale, fmt.Errorf("timeout")); err != db.ErrLeaseLost {
+		t.Errorf("stale claim released: %v, want %v", err, db.ErrLeaseLost)
+	}
+	if err := completePayment(t.Context(), store, current, prot.FallbackProcessor); err != nil {
+		t.Fatal(err)
+	}
+	if err := deadLetter(t.Context(), store, current, fmt.Errorf("late")); err != db.ErrLeaseLost {
+		t.Errorf("settled payment dead-lettered: %v, want %v", err, db.ErrLeaseLost)
+	}
+}
+
+// processor recording the POSTs it gets and answering GET /payments/{id}
+// with lookup
+type fakeProcessor struct {
+	mu     sync.Mutex
+	posts  int
+	lookup int // GET /payments/{id} status
+}
+
+func (fp *fakeProcessor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if r.Method == http.MethodPost {
+		fp.posts++
+		return
+	}
+	w.WriteHeader(fp.lookup)
+}
+
+func (fp *fakeProcessor) sent() int {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.posts
+}
+
+// dead-lettered after a timed out POST the fallback did record, then
+// requeued: the first claim after the requeue must find it on the fallback
+func TestRequeuedPaymentIsLookedUpFirst(t *testing.T) {
+	def := &fakeProcessor{lookup: http.StatusNotFound}
+	fallback := &fakeProcessor{lookup: http.StatusOK}
+	services := newTestServices(t, def, fallback)
+	const id = "00000000-0000-4000-8000-000000000004"
+
+	first := claimed(t, services, id, time.Minute)
+	if err := services.store.MarkFailed(t.Context(), id, first.ClaimedAt, "fallback: timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := services.store.Requeue(t.Context(), []string{id}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := services.store.ClaimNext(t.Context(), id, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Attempts != 1 || !p.Reclaimed {
+		t.Fatalf("claim after requeue: attempts %v, reclaimed %v", p.Attempts, p.Reclaimed)
+	}
+
+	if err := processPayment(t.Context(), services, slog.Default(), p); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := services.store.GetPayment(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != db.StatusCompleted || rec.Service == nil || *rec.Service != prot.FallbackProcessor {
+		t.Errorf("payment %v on %v, want completed on %v", rec.Status, rec.Service, prot.FallbackProcessor)
+	}
+	if n := def.sent() + fallback.sent(); n != 0 {
+		t.Errorf("%v payments sent, the fallback already had it", n)
+	}
+}
+
+// a processor that can't tell whether it has the payment may have it, the
+// payment goes back to the queue instead of being sent to the other one
+func TestNothingSentWhileOwnerUnknown(t *testing.T) {
+	def := &fakeProcessor{lookup: http.StatusInternalServerError}
+	fallback := &fakeProcessor{lookup: http.StatusNotFound}
+	services := newTestServices(t, def, fallback)
+	const id = "00000000-0000-4000-8000-000000000005"
+
+	first := claimed(t, services, id, time.Minute)
+	if err := services.store.Release(t.Context(), id, first.ClaimedAt, "default: timeout"); err != nil {
+		t.Fatal(err)
+	}
+	p, err := services.store.ClaimNext(t.Context(), id, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processPayment(t.Context(), services, slog.Default(), p); err == nil {
+		t.Fatal("payment processed with an unknown owner")
+	}
+	if n := def.sent() + fallback.sent(); n != 0 {
+		t.Errorf("%v payments sent while the owner was unknown", n)
+	}
+	rec, err := services.store.GetPayment(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != db.StatusPending {
+		t.Errorf("payment %v, want %v", rec.Status, db.StatusPending)
+	}
+}
+
+// a round running past what the lease leaves for it is cut short and the
+// payment given back while the lease still holds
+func TestRoundEndsWithinLease(t *testing.T) {
+	unblock := make(chan struct{})
+	hang := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-unblock:
+		}
+	})
+	services := newTestServices(t, hang, hang)
+	t.Cleanup(func() { close(unblock) }) // before the servers close
+	services.leaseTimeout = 2*storeTimeout + 200*time.Millisecond
+	const id = "00000000-0000-4000-8000-000000000006"
+	p := claimed(t, services, id, services.leaseTimeout)
+
+	start := time.Now()
+	if err := processPayment(t.Context(), services, slog.Default(), p); err == nil {
+		t.Fatal("payment processed by processors that never answer")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("round took %v, past the %v lease margin", took, services.leaseTimeout-2*storeTimeout)
+	}
+	rec, err := services.store.GetPayment(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != db.StatusPending {
+		t.Errorf("payment %v, want %v", rec.Status, db.StatusPending)
+	}
+}
@@ -0,0 +1,172 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	db "rinha/internal/database"
+	"rinha/internal/logging"
+	"rinha/internal/metrics"
+	"rinha/internal/processorclient"
+	prot "rinha/pkg/protocol"
+)
+
+// processors allow one service-health call every 5 seconds
+const healthCheckInterval = 5 * time.Second
+
+// latest known health of each payment processor
+type HealthCache struct {
+	mu     sync.RWMutex
+	status map[string]prot.ServiceHealth
+}
+
+func NewHealthCache() *HealthCache {
+	return &HealthCache{status: make(map[string]prot.ServiceHealth)}
+}
+
+func (hc *HealthCache) Get(service string) prot.ServiceHealth {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+	return hc.status[service]
+}
+
+func (hc *HealthCache) set(service string, health prot.ServiceHealth) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	hc.status[service] = health
+}
+
+// routing policy: cheapest usable processor wins, default charges the lower
+// fee so it's used whenever it is up and answers within the processor
+// timeout. A processor slower than that times out on every payment, an up
+// but slow one is still preferred to a failing one. If both are failing keep
+// on default, it's the cheapest one to be paid by once it recovers.
+func (ps *PaymentServices) route() (string, string) {
+	def, fallback := ps.health.Get(prot.DefaultProcessor), ps.health.Get(prot.FallbackProcessor)
+	switch {
+	case ps.usable(def):
+		return prot.DefaultProcessor, *ps.defaultUrl
+	case ps.usable(fallback):
+		return prot.FallbackProcessor, *ps.fallbackUrl
+	case !def.Failing:
+		return prot.DefaultProcessor, *ps.defaultUrl
+	case !fallback.Failing:
+		return prot.FallbackProcessor, *ps.fallbackUrl
+	}
+	return prot.DefaultProcessor, *ps.defaultUrl
+}
+
+// up and answering within the processor timeout
+func (ps *PaymentServices) usable(health prot.ServiceHealth) bool {
+	return !health.Failing && time.Duration(health.MinResponseTime)*time.Millisecond < ps.timeout
+}
+
+// what route() decides on, exposed as metrics
+func (ps *PaymentServices) exportRouting() {
+	routed, _ := ps.route()
+	for _, service := range []string{prot.DefaultProcessor, prot.FallbackProcessor} {
+		health := ps.health.Get(service)
+		failing, current := 0.0, 0.0
+		if health.Failing {
+			failing = 1
+		}
+		if service == routed {
+			current = 1
+		}
+		metrics.ProcessorFailing.WithLabelValues(service).Set(failing)
+		metrics.ProcessorMinResponseTime.WithLabelValues(service).Set(float64(health.MinResponseTime) / 1000)
+		metrics.ProcessorRouted.WithLabelValues(service).Set(current)
+	}
+}
+
+// GET /payments/service-health
+func fetchServiceHealth(ctx context.Context, client *processorclient.Client, baseUrl string) (*prot.ServiceHealth, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	status, body, err := client.Get(ctx, baseUrl+"/payments/service-health")
+	if err != nil {
+		return nil, status, err
+	}
+	if status != http.StatusOK {
+		return nil, status, nil
+	}
+
+	health := &prot.ServiceHealth{}
+	if err := json.Unmarshal(body, health); err != nil {
+		return nil, status, err
+	}
+	return health, status, nil
+}
+
+// poll a processor health if no other worker (from any instance) did it in
+// the last healthCheckInterval
+func checkProcessor(ctx context.Context, store db.Store, client *processorclient.Client, service string, baseUrl string) error {
+	claimed, err := store.ClaimHealthCheck(ctx, service, healthCheckInterval)
+	if err != nil || !claimed {
+		return err
+	}
+
+	health, status, err := fetchServiceHealth(ctx, client, baseUrl)
+	if err != nil || status >= http.StatusInternalServerError {
+		// unreachable processor is as good as a failing one
+		slog.Warn("processor unreachable", logging.Service, service, "status", status, "err", err)
+		health = &prot.ServiceHealth{Failing: true}
+	} else if health == nil {
+		// rate limited or unexpected answer, keep last known state
+		slog.Debug("unexpected health status", logging.Service, service, "status", status)
+		return nil
+	}
+
+	return store.SaveHealth(ctx, service, *health)
+}
+
+// load every processor health into the in memory cache
+func refreshHealth(ctx context.Context, store db.Store, cache *HealthCache) error {
+	health, err := store.LoadHealth(ctx)
+	if err != nil {
+		return err
+	}
+	for service, h := range health {
+		cache.set(service, h)
+	}
+	return nil
+}
+
+// keep processors health up to date, used by processPayment routing
+func healthChecker(ctx context.Context, id uint64, topic string) error {
+	services := ctx.Value("services").(*PaymentServices)
+
+	log := slog.With(logging.WorkerId, id, logging.Topic, topic)
+	log.Debug("watching processors health")
+
+	ticker := time.NewTicker(services.healthRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug("stop processing topic")
+			return nil
+		case <-ticker.C:
+			processors := map[string]string{
+				prot.DefaultProcessor:  *services.defaultUrl,
+				prot.FallbackProcessor: *services.fallbackUrl,
+			}
+			for service, url := range processors {
+				err := checkProcessor(ctx, services.store, services.client, service, url)
+				if err != nil && ctx.Err() == nil {
+					log.Error("health check failed", logging.Service, service, "err", err)
+				}
+			}
+			if err := refreshHealth(ctx, services.store, services.health); err != nil && ctx.Err() == nil {
+				log.Error("refresh health failed", "err", err)
+			}
+			services.exportRouting()
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package listener
+
+import (
+	"testing"
+
+	prot "rinha/pkg/protocol"
+)
+
+func TestRoute(t *testing.T) {
+	services := newTestServices(t, nil, nil) // 5s processor timeout
+	up := prot.ServiceHealth{MinResponseTime: 10}
+	slow := prot.ServiceHealth{MinResponseTime: 6000}
+	failing := prot.ServiceHealth{Failing: true}
+	failingSlow := prot.ServiceHealth{Failing: true, MinResponseTime: 6000}
+
+	for _, tc := range []struct {
+		name          string
+		def, fallback prot.ServiceHealth
+		want          string
+	}{
+		{"both up", up, up, prot.DefaultProcessor},
+		{"default failing", failing, up, prot.FallbackProcessor},
+		{"default slow", slow, up, prot.FallbackProcessor},
+		{"fallback failing", up, failing, prot.DefaultProcessor},
+		{"fallback slow", up, slow, prot.DefaultProcessor},
+		{"both slow", slow, slow, prot.DefaultProcessor},
+		{"default slow, fallback failing", slow, failing, prot.DefaultProcessor},
+		{"default failing, fallback slow", failing, slow, prot.FallbackProcessor},
+		{"both failing", failing, failingSlow, prot.DefaultProcessor},
+	} {
+		services.health.set(prot.DefaultProcessor, tc.def)
+		services.health.set(prot.FallbackProcessor, tc.fallback)
+
+		service, url := services.route()
+		wantUrl := *services.defaultUrl
+		if tc.want == prot.FallbackProcessor {
+			wantUrl = *services.fallbackUrl
+		}
+		if service != tc.want || url != wantUrl {
+			t.Errorf("%v: routed to %v (%v), want %v (%v)", tc.name, service, url, tc.want, wantUrl)
+		}
+	}
+}
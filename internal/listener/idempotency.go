@@ -0,0 +1,51 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	prot "rinha/pkg/protocol"
+)
+
+// GET /payments/{id}, true when the processor has the payment
+func (ps *PaymentServices) hasPayment(ctx context.Context, processorUrl string, correlationId string) (bool, error) {
+	status, _, err := ps.client.Get(ctx, processorUrl+"/payments/"+url.PathEscape(correlationId))
+	if err != nil {
+		return false, err
+	}
+
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status %v", status)
+	}
+}
+
+// which processor owns the payment, empty when none of them has it. Every
+// processor is asked even when one of them can't answer, the other may
+// still own it; "none" is only reported once all of them said so.
+func (ps *PaymentServices) lookupOwner(ctx context.Context, correlationId string) (string, error) {
+	processors := []struct{ service, url string }{
+		{prot.DefaultProcessor, *ps.defaultUrl},
+		{prot.FallbackProcessor, *ps.fallbackUrl},
+	}
+
+	var errs []error
+	for _, proc := range processors {
+		found, err := ps.hasPayment(ctx, proc.url, correlationId)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", proc.service, err))
+			continue
+		}
+		if found {
+			return proc.service, nil
+		}
+	}
+	return "", errors.Join(errs...)
+}
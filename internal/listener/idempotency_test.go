@@ -0,0 +1,31 @@
+package listener
+
+import (
+	"net/http"
+	"testing"
+
+	prot "rinha/pkg/protocol"
+)
+
+// default processor down during the lookup, the fallback still owns it
+func TestLookupOwnerAsksEveryProcessor(t *testing.T) {
+	const id = "00000000-0000-4000-8000-000000000002"
+	down := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	owner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/payments/"+id {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	services := newTestServices(t, down, owner)
+
+	service, err := services.lookupOwner(t.Context(), id)
+	if err != nil || service != prot.FallbackProcessor {
+		t.Errorf("owner %q, %v, want %q", service, err, prot.FallbackProcessor)
+	}
+	service, err = services.lookupOwner(t.Context(), "00000000-0000-4000-8000-000000000003")
+	if err == nil {
+		t.Errorf("owner %q without error, default processor never answered", service)
+	}
+}
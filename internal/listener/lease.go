@@ -0,0 +1,42 @@
+package listener
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"rinha/internal/logging"
+	"rinha/internal/metrics"
+)
+
+// give expired processing leases back to the payments queue, those are
+// payments whose worker died (or hung) while processing them
+func leaseReaper(ctx context.Context, id uint64, topic string) error {
+	services := ctx.Value("services").(*PaymentServices)
+
+	log := slog.With(logging.WorkerId, id, logging.Topic, topic)
+	log.Debug("watching expired leases")
+
+	ticker := time.NewTicker(services.reaperInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug("stop processing topic")
+			return nil
+		case <-ticker.C:
+			n, err := services.store.ReclaimExpired(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error("reclaim leases failed", "err", err)
+				}
+				continue
+			}
+			if n > 0 {
+				metrics.LeasesReclaimed.Add(float64(n))
+				log.Warn("reclaimed expired leases", "count", n)
+			}
+		}
+	}
+}
@@ -2,8 +2,17 @@ package listener
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rinha/internal/config"
+	db "rinha/internal/database"
+	"rinha/internal/logging"
+	"rinha/internal/processorclient"
+	prot "rinha/pkg/protocol"
 )
 
 // notification listener
@@ -11,8 +20,20 @@ import (
 type Topic string
 
 type PaymentServices struct {
-	defaultUrl  *string
-	fallbackUrl *string
+	store          db.Store
+	notified       chan string     // correlation ids notified to the payments channel
+	inflight       context.Context // payments being processed, outlives Stop up to its deadline
+	defaultUrl     *string
+	fallbackUrl    *string
+	health         *HealthCache
+	maxAttempts    int                     // processing rounds before a payment is dead-lettered
+	leaseTimeout   time.Duration           // how long a claimed payment belongs to its worker
+	timeout        time.Duration           // processor call deadline
+	client         *processorclient.Client // shared by every worker
+	retry          retryPolicy
+	pollInterval   time.Duration // idle worker wait for a notification
+	healthRefresh  time.Duration // cached health refresh interval
+	reaperInterval time.Duration // expired leases lookup interval
 }
 
 type Handler func(ctx context.Context, id uint64, topic string) error
@@ -26,61 +47,146 @@ type TopicHandler struct {
 
 type Listener struct {
 	ctx      context.Context
+	abort    context.CancelFunc // cancels in-flight payments too
 	handlers map[string]TopicHandler
+	wg       sync.WaitGroup
+	services *PaymentServices
+	running  atomic.Int64 // handler goroutines alive
+	expected int64        // handler goroutines started
+	stopping atomic.Bool
+}
+
+// what readiness looks at
+type Status struct {
+	Running    int                           // handler goroutines alive
+	Expected   int                           // handler goroutines started
+	Stopping   bool                          // Stop was called
+	Processors map[string]prot.ServiceHealth // last known health of each processor
+}
+
+func (l *Listener) Status() Status {
+	return Status{
+		Running:  int(l.running.Load()),
+		Expected: int(l.expected),
+		Stopping: l.stopping.Load(),
+		Processors: map[string]prot.ServiceHealth{
+			prot.DefaultProcessor:  l.services.health.Get(prot.DefaultProcessor),
+			prot.FallbackProcessor: l.services.health.Get(prot.FallbackProcessor),
+		},
+	}
 }
 
 func (l *Listener) subscribe(poolSize uint64, topic string, callback Handler) {
 	ctx, cancel := context.WithCancel(l.ctx)
 	th := TopicHandler{ctx, cancel, callback, poolSize}
 	l.handlers[topic] = th
-	fmt.Printf("subscribe listener %v\n", topic)
+	slog.Debug("subscribe listener", logging.Topic, topic)
 }
 
 func (l *Listener) unsubcribe(topic string) {
 	if th, ok := l.handlers[topic]; ok {
 		th.cancel()
-		fmt.Printf("unsubscribe listener %v\n", topic)
+		slog.Debug("unsubscribe listener", logging.Topic, topic)
 	}
 }
 
-var l *Listener
+// everything workers share, but the in-flight context Listen sets
+func newPaymentServices(store db.Store, cfg *config.Config) *PaymentServices {
+	return &PaymentServices{
+		store:        store,
+		notified:     make(chan string, notifiedBuffer),
+		defaultUrl:   &cfg.DefaultProcessorUrl,
+		fallbackUrl:  &cfg.FallbackProcessorUrl,
+		health:       NewHealthCache(),
+		maxAttempts:  cfg.MaxAttempts,
+		leaseTimeout: cfg.LeaseTimeout,
+		timeout:      cfg.ProcessorTimeout,
+		client: processorclient.New(processorclient.Options{
+			Timeout:     cfg.ProcessorTimeout,
+			MaxConns:    cfg.Workers + 2, // owner lookups and health checks
+			IdleTimeout: cfg.ProcessorIdleTimeout,
+			HTTP2:       cfg.ProcessorHTTP2,
+		}),
+		retry: retryPolicy{
+			maxAttempts: cfg.Retry.MaxAttempts,
+			baseDelay:   cfg.Retry.BaseDelay,
+			maxDelay:    cfg.Retry.MaxDelay,
+		},
+		pollInterval:   cfg.PollInterval,
+		healthRefresh:  cfg.HealthRefreshInterval,
+		reaperInterval: cfg.ReaperInterval,
+	}
+}
 
-func Listen() {
-	l = &Listener{}
+func Listen(store db.Store, cfg *config.Config) *Listener {
+	l := &Listener{}
 
-	df := os.Getenv("PROCESSOR_DEFAULT_URL")
-	fb := os.Getenv("PROCESSOR_FALLBACK_URL")
-	if df == "" || fb == "" {
-		fmt.Fprintln(os.Stderr, "failed to find default/fallback URL env.")
-		os.Exit(1)
-	}
-	fmt.Println(df)
-	fmt.Println(fb)
+	slog.Info("payment processors", "default", cfg.DefaultProcessorUrl, "fallback", cfg.FallbackProcessorUrl)
 
-	ctxValue := &PaymentServices{
-		defaultUrl:  &df,
-		fallbackUrl: &fb,
-	}
+	inflight, abort := context.WithCancel(context.Background())
+	ctxValue := newPaymentServices(store, cfg)
 
-	l.ctx = context.WithValue(context.Background(), "services", ctxValue)
+	l.ctx = context.WithValue(inflight, "services", ctxValue)
+	l.abort = abort
+	l.services = ctxValue
+	ctxValue.inflight = l.ctx
 	l.handlers = make(map[string]TopicHandler)
 
-	assignTopics()
+	l.assignTopics(uint64(cfg.Workers))
 
 	for key, th := range l.handlers {
-		fmt.Printf("listener initialized handler with pool size: %v\n", th.poolSize)
+		slog.Debug("listener initialized handler", logging.Topic, key, "pool_size", th.poolSize)
 		for i := range th.poolSize { // create pool for each handler subscription
-			go th.callback(th.ctx, i, key)
+			l.wg.Add(1)
+			l.expected++
+			l.running.Add(1)
+			go func() {
+				defer l.wg.Done()
+				defer l.running.Add(-1)
+				if err := th.callback(th.ctx, i, key); err != nil {
+					slog.Error("listener handler stopped", logging.WorkerId, i, logging.Topic, key, "err", err)
+				}
+			}()
 		}
 	}
 
-	fmt.Println("listener started")
+	slog.Info("listener started", "workers", cfg.Workers)
+	return l
 }
 
-func Stop() {
+// stops claiming payments and waits the ones in flight up to timeout, past
+// it they are aborted and released back to pending. Returns once every
+// handler is gone, the store can be closed afterwards.
+func (l *Listener) Stop(timeout time.Duration) error {
+	l.stopping.Store(true)
+	defer l.services.client.Close()
+	defer l.abort()
 	for key := range l.handlers {
 		l.unsubcribe(key)
 	}
 	l.handlers = make(map[string]TopicHandler)
-	fmt.Println("listener stopped")
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		slog.Info("listener stopped")
+		return nil
+	case <-time.After(timeout):
+	}
+
+	slog.Warn("listener drain timed out, releasing in-flight payments", "timeout", timeout)
+	l.abort()
+
+	select {
+	case <-done:
+		slog.Info("listener stopped")
+		return nil
+	case <-time.After(storeTimeout):
+		return errors.New("listener handlers did not stop")
+	}
 }
@@ -0,0 +1,150 @@
+package listener_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	db "rinha/internal/database"
+	"rinha/internal/listener/listenertest"
+	"rinha/internal/processorsim"
+	prot "rinha/pkg/protocol"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// whole listener against the in memory store, processors failing half the time
+func TestListenerSettlesEveryPayment(t *testing.T) {
+	defaultProcessor := processorsim.New(processorsim.DefaultConfig())
+	defaultProcessor.SetFailure(false, 0.5)
+	fallbackProcessor := processorsim.New(processorsim.DefaultConfig())
+	store := listenertest.Start(t, defaultProcessor.Handler(), fallbackProcessor.Handler()).Store
+
+	const n = 50
+	for i := range n {
+		pay := &prot.Payment{CorrelationId: fmt.Sprintf("00000000-0000-4000-8000-%012d", i), Amount: prot.Money(100 + i)}
+		if err := store.InsertPayment(t.Context(), pay); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(20 * time.Second)
+	for {
+		summary, err := store.Summary(t.Context(), db.SummaryWindow{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed := summary[prot.DefaultProcessor].TotalRequests + summary[prot.FallbackProcessor].TotalRequests
+		if completed == n {
+			for service, proc := range map[string]*processorsim.Processor{
+				prot.DefaultProcessor:  defaultProcessor,
+				prot.FallbackProcessor: fallbackProcessor,
+			} {
+				theirs := proc.Summary(time.Time{}, time.Time{})
+				if ours := summary[service]; ours.TotalRequests != theirs.TotalRequests || ours.TotalAmount != theirs.TotalAmount {
+					t.Errorf("%v: ours %+v, processor %+v", service, ours, theirs)
+				}
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v of %v payments completed", completed, n)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// payment stuck on a slow processor past the drain deadline goes back to pending
+func TestStopReleasesInFlightPayments(t *testing.T) {
+	processor := processorsim.New(processorsim.DefaultConfig())
+	processor.SetDelay(2 * time.Second)
+	env := listenertest.Start(t, processor.Handler(), nil)
+	store, l := env.Store, env.Listener
+
+	pay := &prot.Payment{CorrelationId: "00000000-0000-4000-8000-000000000001", Amount: 100}
+	if err := store.InsertPayment(t.Context(), pay); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec, err := store.GetPayment(t.Context(), pay.CorrelationId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Status == db.StatusProcessing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("payment never claimed, status %v", rec.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := l.Stop(100 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := store.GetPayment(t.Context(), pay.CorrelationId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != db.StatusPending {
+		t.Errorf("status %v, want %v", rec.Status, db.StatusPending)
+	}
+}
+
+// the worker span continues the trace that inserted the payment, and the
+// processor gets its traceparent
+func TestProcessingContinuesTheTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	processor := processorsim.New(processorsim.DefaultConfig())
+	traceParents := make(chan string, 1)
+	env := listenertest.Start(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/payments" {
+			select {
+			case traceParents <- r.Header.Get("traceparent"):
+			default:
+			}
+		}
+		processor.Handler().ServeHTTP(w, r)
+	}), nil)
+	store, l := env.Store, env.Listener
+
+	ctx, span := provider.Tracer("test").Start(t.Context(), "POST /payments")
+	pay := &prot.Payment{CorrelationId: "00000000-0000-4000-8000-000000000002", Amount: 100}
+	if err := store.InsertPayment(ctx, pay); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+	traceId := span.SpanContext().TraceID()
+
+	select {
+	case traceParent := <-traceParents:
+		if !strings.Contains(traceParent, traceId.String()) {
+			t.Errorf("processor got traceparent %q, want trace %v", traceParent, traceId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("payment never sent")
+	}
+
+	l.Stop(time.Second)
+	for _, s := range recorder.Ended() {
+		if s.Name() == "payment.process" {
+			if s.SpanContext().TraceID() != traceId {
+				t.Errorf("payment.process in trace %v, want %v", s.SpanContext().TraceID(), traceId)
+			}
+			return
+		}
+	}
+	t.Error("no payment.process span")
+}
@@ -0,0 +1,39 @@
+package listenertest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"rinha/internal/config"
+	"rinha/internal/config/configtest"
+	db "rinha/internal/database"
+	"rinha/internal/listener"
+)
+
+// listener wired to the in memory store and test processors, shared by the
+// listener and api tests
+
+type Env struct {
+	Store    *db.MemoryStore
+	Listener *listener.Listener
+	Config   *config.Config
+}
+
+// serves defaultProcessor and fallbackProcessor (defaultProcessor again when
+// nil) and starts a listener against them with the default config. Listener
+// and servers are stopped at the end of the test, stopping earlier is fine.
+func Start(t testing.TB, defaultProcessor, fallbackProcessor http.Handler) *Env {
+	t.Helper()
+
+	if fallbackProcessor == nil {
+		fallbackProcessor = defaultProcessor
+	}
+	cfg := configtest.WithProcessors(t, defaultProcessor, fallbackProcessor)
+
+	env := &Env{Store: db.NewMemoryStore(), Config: cfg}
+	env.Listener = listener.Listen(env.Store, cfg)
+	// runs before the servers close, cleanups are last in first out
+	t.Cleanup(func() { env.Listener.Stop(time.Second) })
+	return env
+}
@@ -0,0 +1,68 @@
+package listener
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	prot "rinha/pkg/protocol"
+)
+
+type retryPolicy struct {
+	maxAttempts int           // processor calls per claimed payment
+	baseDelay   time.Duration // first backoff, doubled every attempt
+	maxDelay    time.Duration // backoff cap
+}
+
+// full jitter exponential backoff, attempt starts at 1
+func (rp retryPolicy) backoff(attempt int) time.Duration {
+	delay := rp.baseDelay << (attempt - 1)
+	if delay <= 0 || delay > rp.maxDelay {
+		delay = rp.maxDelay
+	}
+	return time.Duration(rand.Int64N(int64(delay) + 1))
+}
+
+type outcome int
+
+const (
+	outcomeCompleted outcome = iota // processor accepted the payment
+	outcomeRetry                    // transient failure, try again
+	outcomeDuplicate                // processor says it already has the payment
+	outcomeRejected                 // processor refused it, retrying won't help
+)
+
+// classify a processor answer, err is a transport error (timeout, refused...)
+func classify(status int, err error) outcome {
+	switch {
+	case err != nil:
+		return outcomeRetry
+	case status >= 200 && status < 300:
+		return outcomeCompleted
+	case status == http.StatusConflict, status == http.StatusUnprocessableEntity:
+		return outcomeDuplicate
+	case status == http.StatusRequestTimeout, status == http.StatusTooManyRequests:
+		return outcomeRetry
+	case status >= 500:
+		return outcomeRetry
+	default:
+		return outcomeRejected
+	}
+}
+
+// where to send the next attempt once one fails: default fails over to
+// fallback unless fallback is known to be failing too, fallback goes back to
+// default
+func (ps *PaymentServices) failover(service string) (string, string) {
+	if service == prot.DefaultProcessor && !ps.health.Get(prot.FallbackProcessor).Failing {
+		return prot.FallbackProcessor, *ps.fallbackUrl
+	}
+	return prot.DefaultProcessor, *ps.defaultUrl
+}
+
+// POST /payments, returns the processor status code
+func (ps *PaymentServices) sendPayment(ctx context.Context, processorUrl string, body []byte) (int, error) {
+	status, _, err := ps.client.Post(ctx, processorUrl+"/payments", body)
+	return status, err
+}
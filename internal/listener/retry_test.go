@@ -0,0 +1,85 @@
+package listener
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	prot "rinha/pkg/protocol"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		status int
+		err    error
+		want   outcome
+	}{
+		{http.StatusOK, nil, outcomeCompleted},
+		{http.StatusCreated, nil, outcomeCompleted},
+		{http.StatusNoContent, nil, outcomeCompleted},
+		{http.StatusConflict, nil, outcomeDuplicate},
+		{http.StatusUnprocessableEntity, nil, outcomeDuplicate},
+		{http.StatusBadRequest, nil, outcomeRejected},
+		{http.StatusNotFound, nil, outcomeRejected},
+		{http.StatusRequestTimeout, nil, outcomeRetry},
+		{http.StatusTooManyRequests, nil, outcomeRetry},
+		{http.StatusInternalServerError, nil, outcomeRetry},
+		{http.StatusBadGateway, nil, outcomeRetry},
+		{http.StatusServiceUnavailable, nil, outcomeRetry},
+		{0, errors.New("connection refused"), outcomeRetry},
+		{http.StatusOK, errors.New("body read timeout"), outcomeRetry},
+	} {
+		if got := classify(tc.status, tc.err); got != tc.want {
+			t.Errorf("classify(%v, %v) = %v, want %v", tc.status, tc.err, got, tc.want)
+		}
+	}
+}
+
+// full jitter, every delay within [0, min(base<<(attempt-1), max)] and
+// spread over it rather than a fixed value
+func TestBackoffBounds(t *testing.T) {
+	rp := retryPolicy{maxAttempts: 10, baseDelay: 10 * time.Millisecond, maxDelay: 100 * time.Millisecond}
+
+	for _, tc := range []struct {
+		attempt int
+		cap     time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{4, 80 * time.Millisecond},
+		{5, 100 * time.Millisecond},
+		{64, 100 * time.Millisecond}, // shift overflow
+	} {
+		seen := map[time.Duration]bool{}
+		for range 200 {
+			delay := rp.backoff(tc.attempt)
+			if delay < 0 || delay > tc.cap {
+				t.Fatalf("backoff(%v) = %v, want within [0, %v]", tc.attempt, delay, tc.cap)
+			}
+			seen[delay] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("backoff(%v) always %v, want jitter", tc.attempt, seen)
+		}
+	}
+}
+
+func TestFailoverAlternates(t *testing.T) {
+	services := newTestServices(t, nil, nil)
+
+	service, url := services.failover(prot.DefaultProcessor)
+	if service != prot.FallbackProcessor || url != *services.fallbackUrl {
+		t.Errorf("default failed over to %v (%v), want fallback", service, url)
+	}
+	service, url = services.failover(service)
+	if service != prot.DefaultProcessor || url != *services.defaultUrl {
+		t.Errorf("fallback failed over to %v (%v), want default", service, url)
+	}
+
+	// nowhere better to go than back to default
+	services.health.set(prot.FallbackProcessor, prot.ServiceHealth{Failing: true})
+	if service, _ := services.failover(prot.DefaultProcessor); service != prot.DefaultProcessor {
+		t.Errorf("default failed over to a failing %v", service)
+	}
+}
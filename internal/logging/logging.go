@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// field names shared by api and listener logs
+const (
+	CorrelationId = "correlation_id"
+	WorkerId      = "worker_id"
+	Topic         = "topic"
+	Service       = "service"
+	Latency       = "latency"
+)
+
+func ParseLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return level, fmt.Errorf("unknown log level %q, use debug, info, warn or error", value)
+	}
+	return level, nil
+}
+
+// text or json handler writing to w, level as accepted by ParseLevel
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, use text or json", format)
+}
+
+// one line per request through logger, replaces chi's middleware.Logger.
+// Only a sample fraction of successful requests is logged (0 disables
+// them), 5xx answers are always logged.
+func RequestLogger(logger *slog.Logger, sample float64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			level := slog.LevelInfo
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			} else if sample <= 0 || (sample < 1 && rand.Float64() >= sample) {
+				return
+			}
+
+			logger.LogAttrs(r.Context(), level, "request",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.Int("status", status),
+				slog.Int("bytes", ww.BytesWritten()),
+				slog.Duration(Latency, time.Since(start)),
+			)
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serve(sample float64, status int) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	logger, _ := New(buf, "info", "json")
+	h := RequestLogger(logger, sample)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/payments", nil))
+	return buf
+}
+
+func TestRequestLogger(t *testing.T) {
+	line := map[string]any{}
+	if err := json.Unmarshal(serve(1, http.StatusOK).Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["path"] != "/payments" || line["status"] != float64(200) || line[Latency] == nil {
+		t.Errorf("unexpected request log %v", line)
+	}
+
+	if out := serve(0, http.StatusOK).String(); out != "" {
+		t.Errorf("disabled request log wrote %q", out)
+	}
+	if out := serve(0, http.StatusInternalServerError).String(); !strings.Contains(out, `"level":"ERROR"`) {
+		t.Errorf("5xx not logged when disabled: %q", out)
+	}
+}
+
+func TestNewRejectsUnknownSettings(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "verbose", "json"); err == nil {
+		t.Error("expected unknown level error")
+	}
+	if _, err := New(&bytes.Buffer{}, "info", "xml"); err == nil {
+		t.Error("expected unknown format error")
+	}
+}
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gathered on scrape, not worth keeping up to date between scrapes
+
+var queueDepthDesc = prometheus.NewDesc("rinha_payments",
+	"Payments per status, pending and processing are the queue depth.", []string{"status"}, nil)
+
+type queueCollector struct {
+	count func(ctx context.Context) (map[string]int, error)
+}
+
+// payments per status counted by count on every scrape
+func NewQueueCollector(count func(ctx context.Context) (map[string]int, error)) prometheus.Collector {
+	return &queueCollector{count}
+}
+
+func (c *queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (c *queueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	counts, err := c.count(ctx)
+	if err != nil {
+		slog.Warn("queue depth metric failed", "err", err)
+		ch <- prometheus.NewInvalidMetric(queueDepthDesc, err)
+		return
+	}
+	for status, n := range counts {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(n), status)
+	}
+}
+
+var (
+	poolAcquired        = prometheus.NewDesc("rinha_pgxpool_acquired_conns", "Connections currently in use.", nil, nil)
+	poolIdle            = prometheus.NewDesc("rinha_pgxpool_idle_conns", "Idle connections.", nil, nil)
+	poolConstructing    = prometheus.NewDesc("rinha_pgxpool_constructing_conns", "Connections being established.", nil, nil)
+	poolTotal           = prometheus.NewDesc("rinha_pgxpool_total_conns", "Connections open.", nil, nil)
+	poolMax             = prometheus.NewDesc("rinha_pgxpool_max_conns", "Pool size limit.", nil, nil)
+	poolAcquires        = prometheus.NewDesc("rinha_pgxpool_acquires_total", "Connections acquired from the pool.", nil, nil)
+	poolEmptyAcquires   = prometheus.NewDesc("rinha_pgxpool_empty_acquires_total", "Acquires that waited for a connection.", nil, nil)
+	poolCanceled        = prometheus.NewDesc("rinha_pgxpool_canceled_acquires_total", "Acquires canceled before getting a connection.", nil, nil)
+	poolAcquireDuration = prometheus.NewDesc("rinha_pgxpool_acquire_duration_seconds_total", "Time spent acquiring connections.", nil, nil)
+)
+
+type poolCollector struct {
+	pool *pgxpool.Pool
+}
+
+// pgxpool.Stat() of pool on every scrape
+func NewPoolCollector(pool *pgxpool.Pool) prometheus.Collector {
+	return &poolCollector{pool}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{poolAcquired, poolIdle, poolConstructing, poolTotal, poolMax,
+		poolAcquires, poolEmptyAcquires, poolCanceled, poolAcquireDuration} {
+		ch <- d
+	}
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	gauge := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v)
+	}
+	counter := func(d *prometheus.Desc, v float64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v)
+	}
+
+	gauge(poolAcquired, float64(stat.AcquiredConns()))
+	gauge(poolIdle, float64(stat.IdleConns()))
+	gauge(poolConstructing, float64(stat.ConstructingConns()))
+	gauge(poolTotal, float64(stat.TotalConns()))
+	gauge(poolMax, float64(stat.MaxConns()))
+	counter(poolAcquires, float64(stat.AcquireCount()))
+	counter(poolEmptyAcquires, float64(stat.EmptyAcquireCount()))
+	counter(poolCanceled, float64(stat.CanceledAcquireCount()))
+	counter(poolAcquireDuration, stat.AcquireDuration().Seconds())
+}
@@ -0,0 +1,122 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// everything exposed by /metrics, api and listener register here
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rinha_http_request_duration_seconds",
+		Help:    "API requests latency per route, its count is the request rate.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method", "route", "status"})
+
+	ProcessorRequests = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rinha_processor_request_duration_seconds",
+		Help:    "POST /payments to a processor latency per answered status code, \"error\" when there was no answer.",
+		Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"service", "code"})
+
+	PaymentsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rinha_payments_completed_total",
+		Help: "Payments completed per processor.",
+	}, []string{"service"})
+
+	Retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rinha_payment_retries_total",
+		Help: "Processor calls retried after a failed attempt, per processor retried on.",
+	}, []string{"service"})
+
+	PaymentsReleased = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rinha_payments_released_total",
+		Help: "Claimed payments given back to the queue after a failed round or on shutdown.",
+	})
+
+	PaymentsDeadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rinha_payments_dead_lettered_total",
+		Help: "Payments moved to the failed state.",
+	})
+
+	LeasesReclaimed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rinha_leases_reclaimed_total",
+		Help: "Processing payments returned to the queue after their lease expired.",
+	})
+
+	// routing decision inputs, see listener route()
+	ProcessorFailing = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rinha_processor_failing",
+		Help: "1 when the processor last reported itself failing.",
+	}, []string{"service"})
+
+	ProcessorMinResponseTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rinha_processor_min_response_time_seconds",
+		Help: "Processor last reported minimum response time.",
+	}, []string{"service"})
+
+	ProcessorRouted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rinha_processor_routed",
+		Help: "1 for the processor new payments are currently sent to.",
+	}, []string{"service"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestDuration,
+		ProcessorRequests,
+		PaymentsCompleted,
+		Retries,
+		PaymentsReleased,
+		PaymentsDeadLettered,
+		LeasesReclaimed,
+		ProcessorFailing,
+		ProcessorMinResponseTime,
+		ProcessorRouted,
+	)
+}
+
+// GET /metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// records requestDuration labelled by chi route pattern, not the raw path,
+// so /payments/{id} is a single series
+func Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestDuration.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// status code label of a processor answer
+func Code(status int, err error) string {
+	if err != nil || status == 0 {
+		return "error"
+	}
+	return strconv.Itoa(status)
+}
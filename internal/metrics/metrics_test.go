@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func scrape(t *testing.T, h http.Handler) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+// one series per route pattern, whatever the id
+func TestInstrumentLabelsRoutePattern(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(Instrument)
+	r.Get("/payments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	for _, id := range []string{"a", "b"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/payments/"+id, nil))
+	}
+
+	out := scrape(t, Handler())
+	want := `rinha_http_request_duration_seconds_count{method="GET",route="/payments/{id}",status="404"} 2`
+	if !strings.Contains(out, want) {
+		t.Errorf("missing %v in\n%v", want, out)
+	}
+}
+
+func TestQueueCollector(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(NewQueueCollector(func(ctx context.Context) (map[string]int, error) {
+		return map[string]int{"pending": 3, "processing": 1}, nil
+	}))
+
+	out := scrape(t, promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	for _, want := range []string{`rinha_payments{status="pending"} 3`, `rinha_payments{status="processing"} 1`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %v in\n%v", want, out)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package processorclient
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"rinha/internal/tracing"
+)
+
+// http client of the payment processors, one per process shared by every
+// worker. Connections are kept alive and reused, so every response body is
+// drained before it's closed.
+
+// answers read past this are dropped, processors answer tiny json bodies
+const maxBody = 64 << 10
+
+type Options struct {
+	Timeout     time.Duration // whole request, response body included
+	MaxConns    int           // connections per processor, idle or in use, about the worker count
+	IdleTimeout time.Duration // idle connections closed after this
+	HTTP2       bool          // h2c to http:// processors, HTTP/2 to https:// ones
+}
+
+type Client struct {
+	http    *http.Client
+	timeout time.Duration
+}
+
+func New(opts Options) *Client {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   opts.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        2 * opts.MaxConns, // default and fallback
+		MaxIdleConnsPerHost: opts.MaxConns,
+		MaxConnsPerHost:     opts.MaxConns, // past it calls wait for a free connection
+		IdleConnTimeout:     opts.IdleTimeout,
+		DisableCompression:  true,
+	}
+	if opts.HTTP2 {
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+	}
+
+	return &Client{
+		http:    &http.Client{Transport: transport},
+		timeout: opts.Timeout,
+	}
+}
+
+// sends a request bounded by the client timeout (or ctx, whichever ends
+// first) with the trace of ctx, returns the status code and the body
+func (c *Client) Do(ctx context.Context, method string, url string, body []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	tracing.Inject(ctx, req.Header)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		// whatever is left, the connection goes back to the pool only once
+		// the body is fully read
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxBody))
+		resp.Body.Close()
+	}()
+
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxBody))
+	return resp.StatusCode, answer, err
+}
+
+func (c *Client) Get(ctx context.Context, url string) (int, []byte, error) {
+	return c.Do(ctx, http.MethodGet, url, nil)
+}
+
+func (c *Client) Post(ctx context.Context, url string, body []byte) (int, []byte, error) {
+	return c.Do(ctx, http.MethodPost, url, body)
+}
+
+// idle connections closed, on shutdown
+func (c *Client) Close() {
+	c.http.CloseIdleConnections()
+}
@@ -0,0 +1,111 @@
+package processorclient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a hung processor costs one timeout, not a worker
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	client := New(Options{Timeout: 50 * time.Millisecond, MaxConns: 1})
+	start := time.Now()
+	_, _, err := client.Post(t.Context(), srv.URL+"/payments", []byte(`{}`))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %v", elapsed)
+	}
+}
+
+// unread bodies are drained, so sequential calls share one connection
+func TestConnectionsAreReused(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 4096)))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := New(Options{Timeout: time.Second, MaxConns: 4, IdleTimeout: time.Minute})
+	for range 10 {
+		status, _, err := client.Get(t.Context(), srv.URL+"/payments/service-health")
+		if err != nil || status != http.StatusOK {
+			t.Fatalf("status %v err %v", status, err)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Errorf("%v connections opened, want 1", n)
+	}
+}
+
+// concurrent calls past MaxConns wait for a connection instead of opening more
+func TestConnectionsAreCapped(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client := New(Options{Timeout: 5 * time.Second, MaxConns: 2, IdleTimeout: time.Minute})
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, _, err := client.Post(t.Context(), srv.URL+"/payments", []byte(`{}`)); err != nil || status != http.StatusOK {
+				t.Errorf("status %v err %v", status, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := conns.Load(); n > 2 {
+		t.Errorf("%v connections opened, want at most 2", n)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	protos := make(chan int, 1)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protos <- r.ProtoMajor
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	client := New(Options{Timeout: time.Second, MaxConns: 1, HTTP2: true})
+	if _, _, err := client.Get(t.Context(), srv.URL+"/payments/service-health"); err != nil {
+		t.Fatal(err)
+	}
+	if proto := <-protos; proto != 2 {
+		t.Errorf("HTTP/%v, want HTTP/2", proto)
+	}
+}
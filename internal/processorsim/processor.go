@@ -0,0 +1,308 @@
+package processorsim
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	p "rinha/pkg/protocol"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+// local stand-in for a rinha payment processor, same contract as
+// zanfranceschi/payment-processor plus failure modes for tests
+
+type Config struct {
+	Fee            float64       // fee charged per transaction, 0.05 is 5%
+	Token          string        // X-Rinha-Token required by /admin routes
+	Delay          time.Duration // added to every POST /payments
+	Failure        bool          // every POST /payments answers 500
+	FailureRate    float64       // fraction of POST /payments answering 500
+	HealthInterval time.Duration // service-health calls allowed once per interval
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Fee:            0.05,
+		Token:          "123",
+		HealthInterval: 5 * time.Second,
+	}
+}
+
+type Payment struct {
+	CorrelationId string    `json:"correlationId"`
+	Amount        p.Money   `json:"amount"`
+	RequestedAt   time.Time `json:"requestedAt"`
+}
+
+type Summary struct {
+	TotalRequests     int     `json:"totalRequests"`
+	TotalAmount       p.Money `json:"totalAmount"`
+	TotalFee          p.Money `json:"totalFee"`
+	FeePerTransaction float64 `json:"feePerTransaction"`
+}
+
+type Processor struct {
+	mu           sync.Mutex
+	cfg          Config
+	payments     map[string]Payment
+	lastHealthAt time.Time
+}
+
+func New(cfg Config) *Processor {
+	return &Processor{cfg: cfg, payments: make(map[string]Payment)}
+}
+
+// payments received so far, for test assertions
+func (ps *Processor) Payments() []Payment {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	payments := make([]Payment, 0, len(ps.payments))
+	for _, pay := range ps.payments {
+		payments = append(payments, pay)
+	}
+	return payments
+}
+
+// totals of payments requested within [from, to], zero times mean unbounded
+func (ps *Processor) Summary(from, to time.Time) Summary {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	summary := Summary{FeePerTransaction: ps.cfg.Fee}
+	for _, pay := range ps.payments {
+		if (!from.IsZero() && pay.RequestedAt.Before(from)) || (!to.IsZero() && pay.RequestedAt.After(to)) {
+			continue
+		}
+		summary.TotalRequests++
+		summary.TotalAmount += pay.Amount
+	}
+	summary.TotalFee = p.Money(math.Round(float64(summary.TotalAmount) * ps.cfg.Fee))
+	return summary
+}
+
+func (ps *Processor) SetDelay(delay time.Duration) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.cfg.Delay = delay
+}
+
+func (ps *Processor) SetFailure(failure bool, rate float64) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.cfg.Failure = failure
+	ps.cfg.FailureRate = rate
+}
+
+func (ps *Processor) Purge() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.payments = make(map[string]Payment)
+}
+
+func (ps *Processor) failing() bool {
+	return ps.cfg.Failure || ps.cfg.FailureRate >= 1
+}
+
+func message(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	render.Status(r, status)
+	render.JSON(w, r, map[string]string{"message": msg})
+}
+
+// POST /payments
+func (ps *Processor) createPayment(w http.ResponseWriter, r *http.Request) {
+	pay := Payment{}
+	if err := json.NewDecoder(r.Body).Decode(&pay); err != nil || !p.IsUUID(pay.CorrelationId) || pay.Amount <= 0 {
+		message(w, r, http.StatusUnprocessableEntity, "invalid payment.")
+		return
+	}
+
+	ps.mu.Lock()
+	delay := ps.cfg.Delay
+	fail := ps.cfg.Failure || (ps.cfg.FailureRate > 0 && rand.Float64() < ps.cfg.FailureRate)
+	ps.mu.Unlock()
+
+	time.Sleep(delay)
+	if fail {
+		message(w, r, http.StatusInternalServerError, "payment processor failure.")
+		return
+	}
+
+	ps.mu.Lock()
+	_, exists := ps.payments[pay.CorrelationId]
+	if !exists {
+		ps.payments[pay.CorrelationId] = pay
+	}
+	ps.mu.Unlock()
+
+	if exists {
+		message(w, r, http.StatusUnprocessableEntity, "CorrelationId already exists")
+		return
+	}
+	message(w, r, http.StatusOK, "payment processed successfully")
+}
+
+// GET /payments/service-health
+func (ps *Processor) serviceHealth(w http.ResponseWriter, r *http.Request) {
+	ps.mu.Lock()
+	now := time.Now()
+	limited := !ps.lastHealthAt.IsZero() && now.Sub(ps.lastHealthAt) < ps.cfg.HealthInterval
+	if !limited {
+		ps.lastHealthAt = now
+	}
+	health := p.ServiceHealth{Failing: ps.failing(), MinResponseTime: int(ps.cfg.Delay.Milliseconds())}
+	ps.mu.Unlock()
+
+	if limited {
+		message(w, r, http.StatusTooManyRequests, "too many requests.")
+		return
+	}
+	render.JSON(w, r, health)
+}
+
+// GET /payments/{id}
+func (ps *Processor) getPayment(w http.ResponseWriter, r *http.Request) {
+	ps.mu.Lock()
+	pay, ok := ps.payments[chi.URLParam(r, "id")]
+	ps.mu.Unlock()
+
+	if !ok {
+		message(w, r, http.StatusNotFound, "payment not found.")
+		return
+	}
+	render.JSON(w, r, pay)
+}
+
+// every /admin route requires X-Rinha-Token
+func (ps *Processor) admin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ps.mu.Lock()
+		token := ps.cfg.Token
+		ps.mu.Unlock()
+
+		if r.Header.Get("X-Rinha-Token") != token {
+			message(w, r, http.StatusUnauthorized, "invalid token.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// from/to query parameters of the /admin routes, zero when missing
+func parseWindow(w http.ResponseWriter, r *http.Request) (time.Time, time.Time, bool) {
+	var from, to time.Time
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			message(w, r, http.StatusBadRequest, "failed to parse 'from' date")
+			return from, to, false
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			message(w, r, http.StatusBadRequest, "failed to parse 'to' date")
+			return from, to, false
+		}
+	}
+	return from, to, true
+}
+
+// GET /admin/payments-summary?from=...&to=...
+func (ps *Processor) adminSummary(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseWindow(w, r)
+	if !ok {
+		return
+	}
+	render.JSON(w, r, ps.Summary(from, to))
+}
+
+// GET /admin/payments?from=...&to=...
+// not in the official processor, lets the reconciler name the payments that differ
+func (ps *Processor) adminPayments(w http.ResponseWriter, r *http.Request) {
+	from, to, ok := parseWindow(w, r)
+	if !ok {
+		return
+	}
+	payments := []Payment{}
+	for _, pay := range ps.Payments() {
+		if (!from.IsZero() && pay.RequestedAt.Before(from)) || (!to.IsZero() && pay.RequestedAt.After(to)) {
+			continue
+		}
+		payments = append(payments, pay)
+	}
+	render.JSON(w, r, payments)
+}
+
+// POST /admin/purge-payments
+func (ps *Processor) purge(w http.ResponseWriter, r *http.Request) {
+	ps.Purge()
+	message(w, r, http.StatusOK, "All payments purged.")
+}
+
+// PUT /admin/configurations/token {"token": "123"}
+func (ps *Processor) setToken(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Token string `json:"token"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		message(w, r, http.StatusBadRequest, "invalid token configuration.")
+		return
+	}
+	ps.mu.Lock()
+	ps.cfg.Token = body.Token
+	ps.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PUT /admin/configurations/delay {"delay": 100}
+func (ps *Processor) setDelay(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Delay int `json:"delay"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Delay < 0 {
+		message(w, r, http.StatusBadRequest, "invalid delay configuration.")
+		return
+	}
+	ps.SetDelay(time.Duration(body.Delay) * time.Millisecond)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PUT /admin/configurations/failure {"failure": true, "failureRate": 0.3}
+func (ps *Processor) setFailure(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Failure     bool    `json:"failure"`
+		FailureRate float64 `json:"failureRate"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.FailureRate < 0 || body.FailureRate > 1 {
+		message(w, r, http.StatusBadRequest, "invalid failure configuration.")
+		return
+	}
+	ps.SetFailure(body.Failure, body.FailureRate)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ps *Processor) Handler() http.Handler {
+	r := chi.NewRouter()
+
+	r.Post("/payments", ps.createPayment)
+	r.Get("/payments/service-health", ps.serviceHealth)
+	r.Get("/payments/{id}", ps.getPayment)
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Use(ps.admin)
+		r.Get("/payments-summary", ps.adminSummary)
+		r.Get("/payments", ps.adminPayments)
+		r.Post("/purge-payments", ps.purge)
+		r.Put("/configurations/token", ps.setToken)
+		r.Put("/configurations/delay", ps.setDelay)
+		r.Put("/configurations/failure", ps.setFailure)
+	})
+
+	return r
+}
@@ -0,0 +1,289 @@
+package reconcile
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	p "rinha/pkg/protocol"
+)
+
+// compares our /payments-summary with each processor /admin/payments-summary,
+// which is what the contest audit does
+
+type Totals struct {
+	TotalRequests int     `json:"totalRequests"`
+	TotalAmount   p.Money `json:"totalAmount"`
+}
+
+type Processor struct {
+	Service string
+	Url     string
+}
+
+type ServiceReport struct {
+	Service string `json:"service"`
+	Ours    Totals `json:"ours"`
+	Theirs  Totals `json:"theirs"`
+	Match   bool   `json:"match"`
+	// only filled on mismatch and when the processor lists its payments
+	MissingOnProcessor []string `json:"missingOnProcessor,omitempty"` // completed by us, unknown to it
+	MissingOnOurs      []string `json:"missingOnOurs,omitempty"`      // known to it, not completed on it by us
+}
+
+type Report struct {
+	From     time.Time       `json:"from"`
+	To       time.Time       `json:"to"`
+	Services []ServiceReport `json:"services"`
+}
+
+func (r *Report) Match() bool {
+	for _, s := range r.Services {
+		if !s.Match {
+			return false
+		}
+	}
+	return true
+}
+
+type Reconciler struct {
+	ApiUrl     string // our api, e.g. http://localhost:9999
+	Processors []Processor
+	Token      string // X-Rinha-Token of processors /admin routes
+	Client     *http.Client
+}
+
+func timeQuery(from, to time.Time) url.Values {
+	query := url.Values{}
+	if !from.IsZero() {
+		query.Set("from", from.UTC().Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		query.Set("to", to.UTC().Format(time.RFC3339Nano))
+	}
+	return query
+}
+
+func (rc *Reconciler) get(ctx context.Context, rawUrl string, admin bool) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if admin {
+		req.Header.Set("X-Rinha-Token", rc.Token)
+	}
+	return rc.Client.Do(req)
+}
+
+func (rc *Reconciler) getJSON(ctx context.Context, rawUrl string, admin bool, v any) error {
+	resp, err := rc.get(ctx, rawUrl, admin)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return fmt.Errorf("GET %v: status %v", rawUrl, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// GET /payments-summary, keyed by service
+func (rc *Reconciler) ours(ctx context.Context, from, to time.Time) (map[string]Totals, error) {
+	summary := map[string]Totals{}
+	err := rc.getJSON(ctx, rc.ApiUrl+"/payments-summary?"+timeQuery(from, to).Encode(), false, &summary)
+	return summary, err
+}
+
+// GET /admin/payments-summary
+func (rc *Reconciler) theirs(ctx context.Context, proc Processor, from, to time.Time) (Totals, error) {
+	totals := Totals{}
+	err := rc.getJSON(ctx, proc.Url+"/admin/payments-summary?"+timeQuery(from, to).Encode(), true, &totals)
+	return totals, err
+}
+
+// correlation ids we completed on service, streamed from GET /payments/export
+func (rc *Reconciler) ourIds(ctx context.Context, service string, from, to time.Time) ([]string, error) {
+	query := timeQuery(from, to)
+	query.Set("format", "ndjson")
+	query.Set("status", "completed")
+	query.Set("service", service)
+
+	resp, err := rc.get(ctx, rc.ApiUrl+"/payments/export?"+query.Encode(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /payments/export: status %v", resp.StatusCode)
+	}
+
+	var ids []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		row := struct {
+			CorrelationId string `json:"correlationId"`
+		}{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, err
+		}
+		ids = append(ids, row.CorrelationId)
+	}
+	return ids, scanner.Err()
+}
+
+// GET /admin/payments, not part of the official processor contract, nil
+// when the processor doesn't expose it
+func (rc *Reconciler) theirIds(ctx context.Context, proc Processor, from, to time.Time) ([]string, error) {
+	resp, err := rc.get(ctx, proc.Url+"/admin/payments?"+timeQuery(from, to).Encode(), true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed {
+		io.Copy(io.Discard, resp.Body)
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("GET /admin/payments: status %v", resp.StatusCode)
+	}
+
+	var payments []struct {
+		CorrelationId string `json:"correlationId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payments); err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(payments))
+	for i, pay := range payments {
+		ids[i] = pay.CorrelationId
+	}
+	return ids, nil
+}
+
+// ids in a but not in b
+func difference(a, b []string) []string {
+	set := make(map[string]struct{}, len(b))
+	for _, id := range b {
+		set[id] = struct{}{}
+	}
+	var diff []string
+	for _, id := range a {
+		if _, ok := set[id]; !ok {
+			diff = append(diff, id)
+		}
+	}
+	slices.Sort(diff)
+	return diff
+}
+
+// compare totals of payments requested within [from, to] per processor
+func (rc *Reconciler) Run(ctx context.Context, from, to time.Time) (*Report, error) {
+	ours, err := rc.ours(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{From: from, To: to}
+	for _, proc := range rc.Processors {
+		theirs, err := rc.theirs(ctx, proc, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", proc.Service, err)
+		}
+
+		sr := ServiceReport{Service: proc.Service, Ours: ours[proc.Service], Theirs: theirs}
+		sr.Match = sr.Ours == sr.Theirs
+
+		if !sr.Match {
+			theirIds, err := rc.theirIds(ctx, proc, from, to)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %w", proc.Service, err)
+			}
+			if theirIds != nil {
+				ourIds, err := rc.ourIds(ctx, proc.Service, from, to)
+				if err != nil {
+					return nil, err
+				}
+				sr.MissingOnProcessor = difference(ourIds, theirIds)
+				sr.MissingOnOurs = difference(theirIds, ourIds)
+			}
+		}
+
+		report.Services = append(report.Services, sr)
+	}
+	return report, nil
+}
+
+// reconcile periodically, reporting mismatches through alert. Each round
+// covers payments requested since the previous successful one, until settle
+// ago (in-flight ones would show up as false mismatches). Windows overlap by
+// settle, a payment requested right before the previous round ended may have
+// settled after it ran.
+func (rc *Reconciler) Watch(ctx context.Context, interval time.Duration, settle time.Duration, alert func(*Report)) {
+	start := time.Now()
+	from := start
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			to := time.Now().Add(-settle)
+			if !to.After(from) {
+				continue // nothing settled since the last round
+			}
+			report, err := rc.Run(ctx, from, to)
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("reconcile failed", "err", err)
+				}
+				continue // next round retries from the same point
+			}
+			if !report.Match() {
+				alert(report)
+			}
+			from = to.Add(-settle)
+			if from.Before(start) {
+				from = start
+			}
+		}
+	}
+}
+
+// human readable report, one line per service plus the differing ids
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "window %v .. %v\n", formatTime(r.From), formatTime(r.To))
+	for _, s := range r.Services {
+		state := "ok"
+		if !s.Match {
+			state = "MISMATCH"
+		}
+		fmt.Fprintf(w, "%-8s %-8s ours %d requests %v, processor %d requests %v\n", s.Service, state,
+			s.Ours.TotalRequests, s.Ours.TotalAmount, s.Theirs.TotalRequests, s.Theirs.TotalAmount)
+		for _, id := range s.MissingOnProcessor {
+			fmt.Fprintf(w, "  completed by us, unknown to %v: %v\n", s.Service, id)
+		}
+		for _, id := range s.MissingOnOurs {
+			fmt.Fprintf(w, "  on %v, not completed there by us: %v\n", s.Service, id)
+		}
+	}
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,193 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	p "rinha/pkg/protocol"
+)
+
+func serve(t *testing.T, mux *http.ServeMux) string {
+	t.Helper()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// processor answering /admin/payments-summary, and /admin/payments when ids
+// isn't nil
+func fakeProcessor(t *testing.T, totals string, ids []string) string {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/payments-summary", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Rinha-Token") != "123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, totals)
+	})
+	if ids != nil {
+		mux.HandleFunc("GET /admin/payments", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "[")
+			for i, id := range ids {
+				if i > 0 {
+					fmt.Fprint(w, ",")
+				}
+				fmt.Fprintf(w, `{"correlationId": %q}`, id)
+			}
+			fmt.Fprint(w, "]")
+		})
+	}
+	return serve(t, mux)
+}
+
+func TestRunReportsDifferingIds(t *testing.T) {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /payments-summary", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"default": {"totalRequests": 2, "totalAmount": 20.00}, "fallback": {"totalRequests": 2, "totalAmount": 6.00}}`)
+	})
+	api.HandleFunc("GET /payments/export", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("status") != "completed" || query.Get("service") != p.FallbackProcessor {
+			t.Errorf("export of %v", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, "{\"correlationId\": \"a\"}\n{\"correlationId\": \"b\"}\n")
+	})
+
+	rc := &Reconciler{
+		ApiUrl: serve(t, api),
+		Processors: []Processor{
+			{p.DefaultProcessor, fakeProcessor(t, `{"totalRequests": 2, "totalAmount": 20.00}`, nil)},
+			{p.FallbackProcessor, fakeProcessor(t, `{"totalRequests": 2, "totalAmount": 7.00}`, []string{"c", "b"})},
+		},
+		Token:  "123",
+		Client: http.DefaultClient,
+	}
+
+	report, err := rc.Run(t.Context(), time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Match() {
+		t.Fatal("report matches, fallback amounts differ")
+	}
+
+	def, fallback := report.Services[0], report.Services[1]
+	if !def.Match || def.MissingOnProcessor != nil || def.MissingOnOurs != nil {
+		t.Errorf("default %+v, want a match", def)
+	}
+	if fallback.Match || !slices.Equal(fallback.MissingOnProcessor, []string{"a"}) || !slices.Equal(fallback.MissingOnOurs, []string{"c"}) {
+		t.Errorf("fallback %+v, want a missing on it, c missing on ours", fallback)
+	}
+}
+
+func TestRunFailsOnProcessorError(t *testing.T) {
+	api := http.NewServeMux()
+	api.HandleFunc("GET /payments-summary", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{}`)
+	})
+	rc := &Reconciler{
+		ApiUrl:     serve(t, api),
+		Processors: []Processor{{p.DefaultProcessor, fakeProcessor(t, `{}`, nil)}},
+		Token:      "wrong",
+		Client:     http.DefaultClient,
+	}
+	if _, err := rc.Run(t.Context(), time.Time{}, time.Time{}); err == nil {
+		t.Error("processor answered 401, want an error")
+	}
+}
+
+func TestDifference(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, want []string
+	}{
+		{nil, nil, nil},
+		{[]string{"a"}, nil, []string{"a"}},
+		{nil, []string{"a"}, nil},
+		{[]string{"c", "a", "b"}, []string{"b"}, []string{"a", "c"}},
+		{[]string{"a", "b"}, []string{"b", "a"}, nil},
+	} {
+		if got := difference(tc.a, tc.b); !slices.Equal(got, tc.want) {
+			t.Errorf("difference(%v, %v) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+// every round starts settle before the end of the last successful one
+func TestWatchWindows(t *testing.T) {
+	const settle = 5 * time.Millisecond
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+
+	type window struct{ from, to time.Time }
+	var (
+		mu      sync.Mutex
+		windows []window
+	)
+	api := http.NewServeMux()
+	api.HandleFunc("GET /payments-summary", func(w http.ResponseWriter, r *http.Request) {
+		from, _ := time.Parse(time.RFC3339Nano, r.URL.Query().Get("from"))
+		to, _ := time.Parse(time.RFC3339Nano, r.URL.Query().Get("to"))
+		mu.Lock()
+		windows = append(windows, window{from, to})
+		round := len(windows)
+		mu.Unlock()
+
+		switch round {
+		case 2: // failing round, retried from the same point
+			w.WriteHeader(http.StatusInternalServerError)
+		case 5:
+			cancel()
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, `{"default": {"totalRequests": 1, "totalAmount": 1.00}}`)
+		}
+	})
+
+	rc := &Reconciler{
+		ApiUrl:     serve(t, api),
+		Processors: []Processor{{p.DefaultProcessor, fakeProcessor(t, `{"totalRequests": 0, "totalAmount": 0}`, nil)}},
+		Token:      "123",
+		Client:     http.DefaultClient,
+	}
+
+	start := time.Now()
+	alerts := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rc.Watch(ctx, 10*time.Millisecond, settle, func(*Report) { alerts++ })
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Watch still running")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if first := windows[0]; first.from.Before(start.Add(-time.Millisecond)) || !first.to.After(first.from) {
+		t.Errorf("first window %v .. %v, want from the start at %v", first.from, first.to, start)
+	}
+	for _, tc := range []struct {
+		round int
+		from  time.Time
+	}{
+		{1, windows[0].to.Add(-settle)},
+		{2, windows[1].from},
+		{3, windows[2].to.Add(-settle)},
+		{4, windows[3].to.Add(-settle)},
+	} {
+		if got := windows[tc.round].from; !got.Equal(tc.from) {
+			t.Errorf("round %v from %v, want %v", tc.round+1, got, tc.from)
+		}
+	}
+	if alerts != 3 {
+		t.Errorf("%v alerts, want one per successful mismatching round (3)", alerts)
+	}
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var (
+	// amounts with more than two decimal places can't be represented as Money
+	ErrMoneyPrecision = errors.New("amount must have at most two decimal places")
+	ErrMoneySyntax    = errors.New("amount must be a number")
+	ErrMoneyRange     = errors.New("amount out of range")
+)
+
+// fixed point money amount in cents, exact where float64 drifts when summing
+type Money int64
+
+var hundred = big.NewRat(100, 1)
+
+// plain decimal syntax, big.Rat alone would also take "1/2" and "0x10"
+var decimalSyntax = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?$`)
+
+// parse a decimal number ("19.90", "19.9", "1e2") into Money
+func ParseMoney(s string) (Money, error) {
+	if !decimalSyntax.MatchString(s) {
+		return 0, fmt.Errorf("%w, got %q", ErrMoneySyntax, s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("%w, got %q", ErrMoneySyntax, s)
+	}
+	r.Mul(r, hundred)
+	if !r.IsInt() {
+		return 0, ErrMoneyPrecision
+	}
+	if !r.Num().IsInt64() {
+		return 0, fmt.Errorf("%w: %s", ErrMoneyRange, s)
+	}
+	return Money(r.Num().Int64()), nil
+}
+
+// always two decimal places, 19.9 is "19.90"
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// encoded as a json number, {"amount": 19.90}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+func (m *Money) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if _, err := strconv.ParseFloat(s, 64); errors.Is(err, strconv.ErrRange) {
+		return fmt.Errorf("%w: %s", ErrMoneyRange, s)
+	} else if err != nil {
+		return fmt.Errorf("%w, got %s", ErrMoneySyntax, s)
+	}
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// pgx numeric decoding
+func (m *Money) ScanNumeric(v pgtype.Numeric) error {
+	if !v.Valid {
+		return errors.New("cannot scan NULL into Money")
+	}
+	if v.NaN || v.InfinityModifier != pgtype.Finite {
+		return errors.New("cannot scan non finite numeric into Money")
+	}
+
+	// cents = Int * 10^(Exp+2)
+	cents := new(big.Int).Set(v.Int)
+	exp := int64(v.Exp) + 2
+	pow := new(big.Int).Exp(big.NewInt(10), big.NewInt(abs(exp)), nil)
+	if exp >= 0 {
+		cents.Mul(cents, pow)
+	} else {
+		var rem big.Int
+		cents.QuoRem(cents, pow, &rem)
+		if rem.Sign() != 0 {
+			return ErrMoneyPrecision
+		}
+	}
+
+	if !cents.IsInt64() {
+		return errors.New("numeric out of Money range")
+	}
+	*m = Money(cents.Int64())
+	return nil
+}
+
+// pgx numeric encoding
+func (m Money) NumericValue() (pgtype.Numeric, error) {
+	return pgtype.Numeric{Int: big.NewInt(int64(m)), Exp: -2, Valid: true}, nil
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
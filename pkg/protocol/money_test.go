@@ -0,0 +1,149 @@
+package protocol
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestParseMoney(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Money
+		err  error // nil when any error will do, see ok
+		ok   bool
+	}{
+		{"19.90", 19_90, nil, true},
+		{"19.9", 19_90, nil, true},
+		{"19", 19_00, nil, true},
+		{"1e2", 100_00, nil, true},
+		{"1.5e-1", 15, nil, true},
+		{"-0.01", -1, nil, true},
+		{"0", 0, nil, true},
+		{"0.001", 0, ErrMoneyPrecision, false},
+		{"1e-3", 0, ErrMoneyPrecision, false},
+		{"92233720368547758.07", 1<<63 - 1, nil, true},
+		{"92233720368547758.08", 0, ErrMoneyRange, false},
+		{"abc", 0, ErrMoneySyntax, false},
+		{"", 0, ErrMoneySyntax, false},
+		{"1/2", 0, ErrMoneySyntax, false},
+		{"0x10", 0, ErrMoneySyntax, false},
+		{"0b1", 0, ErrMoneySyntax, false},
+		{" 1", 0, ErrMoneySyntax, false},
+		{"1e", 0, ErrMoneySyntax, false},
+		{"Inf", 0, ErrMoneySyntax, false},
+		{"+.5", 50, nil, true},
+		{"5.", 5_00, nil, true},
+	} {
+		got, err := ParseMoney(tc.in)
+		switch {
+		case tc.ok && (err != nil || got != tc.want):
+			t.Errorf("ParseMoney(%q) = %v, %v, want %v", tc.in, got, err, tc.want)
+		case !tc.ok && err == nil:
+			t.Errorf("ParseMoney(%q) = %v, want an error", tc.in, got)
+		case tc.err != nil && !errors.Is(err, tc.err):
+			t.Errorf("ParseMoney(%q) error %v, want %v", tc.in, err, tc.err)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Money
+		err  error
+		ok   bool
+	}{
+		{"19.9", 19_90, nil, true},
+		{"1e2", 100_00, nil, true},
+		{"null", 7, nil, true}, // left untouched
+		{"0.001", 0, ErrMoneyPrecision, false},
+		{"1e400", 0, ErrMoneyRange, false},
+		{"92233720368547758.08", 0, ErrMoneyRange, false},
+		{`"19.90"`, 0, ErrMoneySyntax, false},
+		{"true", 0, ErrMoneySyntax, false},
+	} {
+		got := Money(7)
+		err := got.UnmarshalJSON([]byte(tc.in))
+		switch {
+		case tc.ok && (err != nil || got != tc.want):
+			t.Errorf("UnmarshalJSON(%s) = %v, %v, want %v", tc.in, got, err, tc.want)
+		case !tc.ok && err == nil:
+			t.Errorf("UnmarshalJSON(%s) = %v, want an error", tc.in, got)
+		case tc.err != nil && !errors.Is(err, tc.err):
+			t.Errorf("UnmarshalJSON(%s) error %v, want %v", tc.in, err, tc.err)
+		}
+	}
+}
+
+func TestMoneyMarshalJSON(t *testing.T) {
+	for _, tc := range []struct {
+		in   Money
+		want string
+	}{
+		{19_90, "19.90"},
+		{5, "0.05"},
+		{0, "0.00"},
+		{-5, "-0.05"},
+		{-19_90, "-19.90"},
+		{100_00, "100.00"},
+	} {
+		got, err := tc.in.MarshalJSON()
+		if err != nil || string(got) != tc.want {
+			t.Errorf("MarshalJSON(%d) = %s, %v, want %s", int64(tc.in), got, err, tc.want)
+		}
+	}
+}
+
+func TestMoneyScanNumeric(t *testing.T) {
+	for _, tc := range []struct {
+		int  int64
+		exp  int32
+		want Money
+		err  error
+		ok   bool
+	}{
+		{1990, -2, 19_90, nil, true},
+		{199, -1, 19_90, nil, true},
+		{19900, -3, 19_90, nil, true},
+		{2, 1, 20_00, nil, true},
+		{-5, 0, -5_00, nil, true},
+		{0, 3, 0, nil, true},
+		{1, -3, 0, ErrMoneyPrecision, false},
+		{1, 18, 0, nil, false}, // 10^20 cents
+	} {
+		var got Money
+		err := got.ScanNumeric(pgtype.Numeric{Int: big.NewInt(tc.int), Exp: tc.exp, Valid: true})
+		switch {
+		case tc.ok && (err != nil || got != tc.want):
+			t.Errorf("ScanNumeric(%de%d) = %v, %v, want %v", tc.int, tc.exp, got, err, tc.want)
+		case !tc.ok && err == nil:
+			t.Errorf("ScanNumeric(%de%d) = %v, want an error", tc.int, tc.exp, got)
+		case tc.err != nil && !errors.Is(err, tc.err):
+			t.Errorf("ScanNumeric(%de%d) error %v, want %v", tc.int, tc.exp, err, tc.err)
+		}
+	}
+
+	var m Money
+	if err := m.ScanNumeric(pgtype.Numeric{}); err == nil {
+		t.Error("NULL scanned into Money")
+	}
+	if err := m.ScanNumeric(pgtype.Numeric{NaN: true, Valid: true}); err == nil {
+		t.Error("NaN scanned into Money")
+	}
+}
+
+func TestMoneyNumericRoundTrip(t *testing.T) {
+	for _, m := range []Money{0, 1, 19_90, -19_90, 1<<63 - 1} {
+		v, err := m.NumericValue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Money
+		if err := got.ScanNumeric(v); err != nil || got != m {
+			t.Errorf("%v round tripped to %v, %v", m, got, err)
+		}
+	}
+}
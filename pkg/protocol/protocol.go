@@ -1,6 +1,9 @@
 package protocol
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // postgres notify/listen protocol
 
@@ -10,12 +13,60 @@ const (
 	Payments Topic = "payments_queue"
 )
 
+// payment processors, the default one charges the lowest fee
+const (
+	DefaultProcessor  = "default"
+	FallbackProcessor = "fallback"
+)
+
 type Payment struct {
-	CorrelationId string  `json:"correlationId"`
-	Amount        float64 `json:"amount"`
+	CorrelationId string `json:"correlationId"`
+	Amount        Money  `json:"amount"`
+	amountSet     bool   // decoded with an amount, a zero one is then invalid, not missing
 }
 
 type ProcessingPayment struct {
 	*Payment
 	RequestedAt time.Time `json:"requestedAt"`
+	Attempts    int       `json:"-"` // processing rounds, including the current one
+	TraceParent string    `json:"-"` // trace of the request that created it, empty when untraced
+	ClaimedAt   time.Time `json:"-"` // claim token, outcomes are only recorded while it still holds
+	Reclaimed   bool      `json:"-"` // claimed before (retried, reaped or requeued), a processor may already have it
+}
+
+func (pay *Payment) UnmarshalJSON(b []byte) error {
+	var fields struct {
+		CorrelationId string `json:"correlationId"`
+		Amount        *Money `json:"amount"`
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	*pay = Payment{CorrelationId: fields.CorrelationId, amountSet: fields.Amount != nil}
+	if fields.Amount != nil {
+		pay.Amount = *fields.Amount
+	}
+	return nil
+}
+
+// its own decoding, the one promoted from Payment would skip requestedAt
+func (pp *ProcessingPayment) UnmarshalJSON(b []byte) error {
+	pay := &Payment{}
+	if err := json.Unmarshal(b, pay); err != nil {
+		return err
+	}
+	var fields struct {
+		RequestedAt time.Time `json:"requestedAt"`
+	}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return err
+	}
+	pp.Payment, pp.RequestedAt = pay, fields.RequestedAt
+	return nil
+}
+
+// GET /payments/service-health answer
+type ServiceHealth struct {
+	Failing         bool `json:"failing"`
+	MinResponseTime int  `json:"minResponseTime"`
 }
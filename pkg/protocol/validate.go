@@ -0,0 +1,116 @@
+package protocol
+
+import (
+	"errors"
+	"strings"
+)
+
+// field validation error codes
+const (
+	Required = "required" // field missing
+	Invalid  = "invalid"  // field present but unacceptable
+)
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ValidationErrors []FieldError
+
+func (ve ValidationErrors) Error() string {
+	msgs := make([]string, len(ve))
+	for i, fe := range ve {
+		msgs[i] = fe.Field + ": " + fe.Message
+	}
+	return strings.Join(msgs, ", ")
+}
+
+// field errors carried by err, Money decoding errors are reported on amount
+func FieldErrors(err error) (ValidationErrors, bool) {
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		return errs, true
+	}
+	switch {
+	case errors.Is(err, ErrMoneyPrecision):
+		return ValidationErrors{{"amount", Invalid, "amount must have at most two decimal places."}}, true
+	case errors.Is(err, ErrMoneySyntax):
+		return ValidationErrors{{"amount", Invalid, "amount must be a number."}}, true
+	case errors.Is(err, ErrMoneyRange):
+		return ValidationErrors{{"amount", Invalid, "amount is out of range."}}, true
+	}
+	return nil, false
+}
+
+// canonical 8-4-4-4-12 hex uuid
+func IsUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p *Payment) Validate() error {
+	var errs ValidationErrors
+
+	switch {
+	case p.CorrelationId == "":
+		errs = append(errs, FieldError{"correlationId", Required, "correlationId is required."})
+	case !IsUUID(p.CorrelationId):
+		errs = append(errs, FieldError{"correlationId", Invalid, "correlationId must be an uuid."})
+	}
+
+	// Money decoding already rejects more than two decimal places
+	switch {
+	case p.Amount == 0 && !p.amountSet:
+		errs = append(errs, FieldError{"amount", Required, "amount is required."})
+	case p.Amount <= 0:
+		errs = append(errs, FieldError{"amount", Invalid, "amount must be greater than zero."})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (pp *ProcessingPayment) Validate() error {
+	var errs ValidationErrors
+
+	if pp.Payment == nil {
+		errs = append(errs, MissingPayment()...)
+	} else if err := pp.Payment.Validate(); err != nil {
+		errs = append(errs, err.(ValidationErrors)...)
+	}
+
+	if pp.RequestedAt.IsZero() {
+		errs = append(errs, FieldError{"requestedAt", Required, "requestedAt is required."})
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// payload without any payment field
+func MissingPayment() ValidationErrors {
+	return ValidationErrors{
+		{"correlationId", Required, "correlationId is required."},
+		{"amount", Required, "amount is required."},
+	}
+}